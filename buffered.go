@@ -0,0 +1,140 @@
+package juggler
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"sync/atomic"
+	"time"
+)
+
+const defaultQueueSize = 1024
+
+type writeRequest struct {
+	p       []byte
+	flushed chan error
+}
+
+// enqueue hands a copy of p over to the writer goroutine, when the queue is full
+// it either waits or drops p depending on the configuration
+func (j *Juggler) enqueue(p []byte) (int, error) {
+	b := make([]byte, len(p))
+	copy(b, p)
+
+	j.qmu.RLock()
+	defer j.qmu.RUnlock()
+
+	if j.closed {
+		return 0, opError(OpWrite, "", ErrClosed, false)
+	}
+
+	if !j.dropOnFull {
+		j.queue <- writeRequest{p: b}
+		return len(p), nil
+	}
+
+	select {
+	case j.queue <- writeRequest{p: b}:
+	default:
+		atomic.AddUint64(&j.dropped, 1)
+	}
+
+	return len(p), nil
+}
+
+// drain writes queued entries in order and flushes the buffer periodically
+func (j *Juggler) drain() {
+	defer close(j.drained)
+
+	var flushCh <-chan time.Time
+	if j.flushInterval > 0 {
+		tick := time.NewTicker(j.flushInterval)
+		defer tick.Stop()
+		flushCh = tick.C
+	}
+
+	var reported uint64
+
+	for {
+		select {
+		case req, ok := <-j.queue:
+			if !ok {
+				return
+			}
+
+			if req.flushed != nil {
+				req.flushed <- j.flush()
+				continue
+			}
+
+			if _, err := j.write(req.p); err != nil {
+				j.reportError(err)
+			}
+		case <-flushCh:
+			if err := j.flush(); err != nil {
+				j.reportError(err)
+			}
+
+			if dropped := atomic.LoadUint64(&j.dropped); dropped > reported {
+				j.reportError(opError(OpWrite, "", errors.Wrapf(ErrQueueFull, "%d writes dropped", dropped-reported), false))
+				reported = dropped
+			}
+		}
+	}
+}
+
+// Flush writes buffered entries to the current file, it waits for
+// the entries queued before the call to be written as well
+func (j *Juggler) Flush() error {
+	if j.queue == nil {
+		return nil
+	}
+
+	flushed := make(chan error, 1)
+
+	j.qmu.RLock()
+	if j.closed {
+		j.qmu.RUnlock()
+		return nil
+	}
+
+	j.queue <- writeRequest{flushed: flushed}
+	j.qmu.RUnlock()
+
+	return <-flushed
+}
+
+// Dropped returns the number of writes dropped because the write queue was full
+func (j *Juggler) Dropped() uint64 {
+	return atomic.LoadUint64(&j.dropped)
+}
+
+func (j *Juggler) flush() error {
+	j.cmu.Lock()
+	defer j.cmu.Unlock()
+
+	if j.buffer == nil {
+		return nil
+	}
+
+	if err := j.buffer.Flush(); err != nil {
+		return opError(OpWrite, j.currentFilepath, errors.Wrapf(err, "could not flush buffer to %s", j.currentFilepath), false)
+	}
+
+	return nil
+}
+
+// attachBuffer puts a buffer in front of the current file if buffering is enabled
+func (j *Juggler) attachBuffer() {
+	if j.bufferSize > 0 && j.currentFile != nil {
+		j.buffer = bufio.NewWriterSize(j.currentFile, j.bufferSize)
+	}
+}
+
+// buffered returns the number of bytes written but not flushed to the current file yet
+func (j *Juggler) buffered() int64 {
+	if j.buffer == nil {
+		return 0
+	}
+
+	return int64(j.buffer.Buffered())
+}
@@ -0,0 +1,106 @@
+package juggler
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBufferedWrites(t *testing.T) {
+	nowFunc := createNowFunc(dateSuffix, "2020-01-01")
+	megabyte = 1024 * 1024
+
+	t.Run("entries are written on flush", func(t *testing.T) {
+		dir := makeTestDir(randomString(20), t)
+		defer os.RemoveAll(dir)
+
+		j := New("test_log", dir, WithBufferedWrites(4096, time.Hour), withNowFunc(nowFunc))
+		defer j.Close()
+
+		expectedFile := filepath.Join(dir, "test_log-2020-01-01.1.log")
+
+		_, err := j.Write([]byte("first\n"))
+		assert.NoError(t, err)
+		_, err = j.Write([]byte("second\n"))
+		assert.NoError(t, err)
+
+		assert.NoError(t, j.Flush())
+
+		ok, err := expectFileToContain(expectedFile, []byte("first\nsecond\n"))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("entries are flushed periodically", func(t *testing.T) {
+		dir := makeTestDir(randomString(20), t)
+		defer os.RemoveAll(dir)
+
+		j := New("test_log", dir, WithBufferedWrites(4096, 50*time.Millisecond), withNowFunc(nowFunc))
+		defer j.Close()
+
+		_, err := j.Write([]byte("entry\n"))
+		assert.NoError(t, err)
+
+		assert.Eventually(t, func() bool {
+			ok, _ := expectFileToContain(filepath.Join(dir, "test_log-2020-01-01.1.log"), []byte("entry\n"))
+			return ok
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("queued entries are written on close", func(t *testing.T) {
+		dir := makeTestDir(randomString(20), t)
+		defer os.RemoveAll(dir)
+
+		j := New("test_log", dir, WithBufferedWrites(4096, time.Hour), withNowFunc(nowFunc))
+
+		for i := 0; i < 100; i++ {
+			_, err := j.Write([]byte("entry\n"))
+			assert.NoError(t, err)
+		}
+
+		assert.NoError(t, j.Close())
+
+		_, err := j.Write([]byte("entry\n"))
+		assert.Error(t, err)
+
+		ok, err := expectFileToContain(filepath.Join(dir, "test_log-2020-01-01.1.log"), bytes.Repeat([]byte("entry\n"), 100))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("entries are dropped when the queue is full", func(t *testing.T) {
+		dir := makeTestDir(randomString(20), t)
+		defer os.RemoveAll(dir)
+
+		j := New(
+			"test_log",
+			dir,
+			WithBufferedWrites(4096, time.Hour),
+			WithQueueSize(2),
+			WithDropOnFullQueue(),
+			withNowFunc(nowFunc),
+		)
+
+		// the writer goroutine is stuck while the lock is held, so the queue fills up
+		j.cmu.Lock()
+		for i := 0; i < 10; i++ {
+			n, err := j.Write([]byte("entry\n"))
+			assert.NoError(t, err)
+			assert.Equal(t, 6, n)
+		}
+		j.cmu.Unlock()
+
+		assert.NoError(t, j.Close())
+
+		dropped := j.Dropped()
+		assert.True(t, dropped >= 7, "expected at least 7 writes dropped, got %d", dropped)
+
+		b, err := ioutil.ReadFile(filepath.Join(dir, "test_log-2020-01-01.1.log"))
+		assert.NoError(t, err)
+		assert.Equal(t, 10-int(dropped), bytes.Count(b, []byte("entry\n")))
+	})
+}
@@ -0,0 +1,138 @@
+package cloud
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/denismitr/juggler/codec"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// checksumMetadata holds the hex encoded SHA-256 of uploaded files
+const checksumMetadata = "Sha256"
+
+// fileChecksums reads the file to compute its MD5 and SHA-256
+func fileChecksums(fp string) ([]byte, []byte, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, nil, opError(OpUpload, "", fp, errors.Wrapf(err, "could not open %s to compute checksums", fp))
+	}
+
+	defer f.Close()
+
+	md5sum, sha256sum := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5sum, sha256sum), f); err != nil {
+		return nil, nil, opError(OpUpload, "", fp, errors.Wrapf(err, "could not read %s to compute checksums", fp))
+	}
+
+	return md5sum.Sum(nil), sha256sum.Sum(nil), nil
+}
+
+// uploadPartSize returns the part size the uploader goes with for a file of the given size
+func uploadPartSize(size, partSize int64) int64 {
+	if partSize < s3manager.MinUploadPartSize {
+		partSize = s3manager.DefaultUploadPartSize
+	}
+
+	if size/partSize >= int64(s3manager.MaxUploadParts) {
+		partSize = size/int64(s3manager.MaxUploadParts) + 1
+	}
+
+	return partSize
+}
+
+// multipartETag computes the ETag S3 gives to objects uploaded in parts,
+// which is the MD5 of the MD5s of the parts followed by the number of parts
+func multipartETag(fp string, partSize int64) (string, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return "", opError(OpUpload, "", fp, errors.Wrapf(err, "could not open %s to compute checksums", fp))
+	}
+
+	defer f.Close()
+
+	var sums []byte
+	parts := 0
+
+	for {
+		part := md5.New()
+		n, err := io.CopyN(part, f, partSize)
+		if n > 0 {
+			sums = append(sums, part.Sum(nil)...)
+			parts++
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return "", opError(OpUpload, "", fp, errors.Wrapf(err, "could not read %s to compute checksums", fp))
+		}
+	}
+
+	all := md5.Sum(sums)
+
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(all[:]), parts), nil
+}
+
+// matches compares the stored object with the expected checksums. Objects uploaded without
+// the SHA-256 are compared by the ETag only, ETags of objects encrypted with KMS or customer
+// keys are not MD5s and are not compared.
+func matches(head *s3.HeadObjectOutput, etag string, sha256sum []byte) error {
+	var stored string
+	for k, v := range head.Metadata {
+		if strings.EqualFold(k, checksumMetadata) {
+			stored = aws.StringValue(v)
+		}
+	}
+
+	encrypted := aws.StringValue(head.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms || head.SSECustomerAlgorithm != nil
+
+	if stored == "" && encrypted {
+		return errors.Wrap(ErrChecksumMismatch, "stored object has no SHA-256 to compare")
+	}
+
+	if expected := hex.EncodeToString(sha256sum); stored != "" && stored != expected {
+		return errors.Wrapf(ErrChecksumMismatch, "stored SHA-256 %q differs from %q", stored, expected)
+	}
+
+	if encrypted {
+		return nil
+	}
+
+	if got := strings.Trim(aws.StringValue(head.ETag), `"`); got != etag {
+		return errors.Wrapf(ErrChecksumMismatch, "stored ETag %q differs from %q", got, etag)
+	}
+
+	return nil
+}
+
+// expectedETag returns the ETag the file would get as the stored object, which
+// depends on whether the object was uploaded at once or in parts
+func expectedETag(fp string, head *s3.HeadObjectOutput, size, partSize int64, md5sum []byte) (string, error) {
+	if !strings.Contains(aws.StringValue(head.ETag), "-") {
+		return hex.EncodeToString(md5sum), nil
+	}
+
+	return multipartETag(fp, uploadPartSize(size, partSize))
+}
+
+// collisionKey makes a key for a file differing from the object stored under key
+// by inserting the beginning of the SHA-256 of the file before its extension
+func collisionKey(key string, sha256sum []byte) string {
+	ext := path.Ext(key)
+	if c, ok := codec.ByExtension(key); ok {
+		ext = path.Ext(strings.TrimSuffix(key, c.Extension())) + c.Extension()
+	}
+
+	return strings.TrimSuffix(key, ext) + "." + hex.EncodeToString(sha256sum)[:12] + ext
+}
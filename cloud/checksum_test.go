@@ -0,0 +1,91 @@
+package cloud
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "juggler-checksums")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	content := []byte("0123456789ab")
+	fp := filepath.Join(dir, "app-2020-10-11.1.log.gz")
+	require.NoError(t, ioutil.WriteFile(fp, content, 0600))
+
+	t.Run("file checksums", func(t *testing.T) {
+		md5sum, sha256sum, err := fileChecksums(fp)
+		require.NoError(t, err)
+
+		expectedMD5 := md5.Sum(content)
+		expectedSHA256 := sha256.Sum256(content)
+		assert.Equal(t, expectedMD5[:], md5sum)
+		assert.Equal(t, expectedSHA256[:], sha256sum)
+	})
+
+	t.Run("multipart etag", func(t *testing.T) {
+		var sums []byte
+		for _, part := range [][]byte{content[:5], content[5:10], content[10:]} {
+			sum := md5.Sum(part)
+			sums = append(sums, sum[:]...)
+		}
+
+		all := md5.Sum(sums)
+
+		etag, err := multipartETag(fp, 5)
+		require.NoError(t, err)
+		assert.Equal(t, hex.EncodeToString(all[:])+"-3", etag)
+	})
+
+	t.Run("part size", func(t *testing.T) {
+		assert.Equal(t, int64(s3manager.DefaultUploadPartSize), uploadPartSize(1024, 0))
+		assert.Equal(t, int64(s3manager.DefaultUploadPartSize), uploadPartSize(1024, 1))
+
+		huge := int64(s3manager.MaxUploadParts) * s3manager.DefaultUploadPartSize
+		assert.Equal(t, huge/int64(s3manager.MaxUploadParts)+1, uploadPartSize(huge, s3manager.DefaultUploadPartSize))
+	})
+
+	t.Run("stored object", func(t *testing.T) {
+		sha256sum := sha256.Sum256(content)
+		shaHex := hex.EncodeToString(sha256sum[:])
+
+		head := &s3.HeadObjectOutput{
+			ETag:     aws.String(`"abc"`),
+			Metadata: map[string]*string{"Sha256": aws.String(shaHex)},
+		}
+
+		assert.NoError(t, matches(head, "abc", sha256sum[:]))
+		assert.True(t, errors.Is(matches(head, "abd", sha256sum[:]), ErrChecksumMismatch))
+		assert.Error(t, matches(&s3.HeadObjectOutput{
+			ETag:     aws.String(`"abc"`),
+			Metadata: map[string]*string{"Sha256": aws.String("0" + shaHex[1:])},
+		}, "abc", sha256sum[:]))
+
+		assert.NoError(t, matches(&s3.HeadObjectOutput{ETag: aws.String(`"abc"`)}, "abc", sha256sum[:]), "objects without SHA-256 are compared by ETag")
+
+		head.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		assert.NoError(t, matches(head, "abd", sha256sum[:]), "ETags of KMS encrypted objects are not MD5s")
+
+		head.Metadata = nil
+		assert.Error(t, matches(head, "abc", sha256sum[:]), "KMS encrypted objects without SHA-256 cannot be compared")
+	})
+
+	t.Run("collision key", func(t *testing.T) {
+		sum := []byte{0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67}
+
+		assert.Equal(t, "logs/app-2020-10-11.1.abcdef012345.log.gz", collisionKey("logs/app-2020-10-11.1.log.gz", sum))
+		assert.Equal(t, "app-2020-10-11.1.abcdef012345.log", collisionKey("app-2020-10-11.1.log", sum))
+	})
+}
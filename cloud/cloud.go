@@ -1,18 +1,27 @@
 package cloud
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/denismitr/juggler/codec"
 	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
+	"time"
 )
 
 const logFileContentType = "text/plain"
-const logFileContentEncoding = "gzip"
 
+// Config of the S3 connection, Id and Secret are optional, without them credentials
+// are taken from the environment as the AWS CLI does, see Profile
 type Config struct {
 	Region   string
 	Id       string
@@ -21,11 +30,52 @@ type Config struct {
 	Endpoint string
 	Acl      string
 	NoSSL    bool
+
+	// WriteOnly uploads without looking up and reading back objects, for credentials allowed
+	// s3:PutObject only. Objects stored already are overwritten then, and only single part
+	// uploads are checked, by S3 against the MD5 sent along.
+	WriteOnly bool
+
+	// SessionToken goes with temporary static keys
+	SessionToken string
+	// Profile of the shared credentials and config files, AWS_PROFILE or default if empty
+	Profile string
+
+	// KeyPrefix is prepended to every object key, e.g. logs/my-app
+	KeyPrefix string
+	// KeyTemplate lays out object keys under the prefix, DefaultKeyTemplate is used if empty.
+	// Supported tokens are {filename}, {host}, {instance} and {year}, {month}, {day}, {hour}
+	// taken from the date of the log file, see HiveKeyTemplate.
+	KeyTemplate string
+	// FilenameTemplate is the template given to juggler.WithFilenameTemplate, if any. Files named
+	// by nested templates keep their path relative to the log directory in {filename}.
+	FilenameTemplate string
+	// Host defaults to the host name
+	Host string
+	// InstanceID tells apart instances running on the same host, defaults to Host
+	InstanceID string
+
+	// StorageClass of uploaded objects, e.g. STANDARD_IA or GLACIER, the bucket default if empty
+	StorageClass string
+	// ServerSideEncryption is AES256 for SSE-S3 or aws:kms for SSE-KMS
+	ServerSideEncryption string
+	// SSEKMSKeyID selects the KMS key, it implies aws:kms encryption
+	SSEKMSKeyID string
+	// Tags are added to uploaded objects, values may contain the tokens of KeyTemplate
+	Tags map[string]string
+	// Metadata is added to uploaded objects, values may contain the tokens of KeyTemplate
+	Metadata map[string]string
+	// ObjectLockMode is GOVERNANCE or COMPLIANCE, objects are locked for ObjectLockRetention
+	ObjectLockMode      string
+	ObjectLockRetention time.Duration
+	// ObjectLockLegalHold puts uploaded objects on legal hold
+	ObjectLockLegalHold bool
 }
 
 type S3GzipCloud struct {
-	cfg Config
-	s   *session.Session
+	cfg  Config
+	keys keyLayout
+	s    *session.Session
 }
 
 func New(cfg Config) (*S3GzipCloud, error) {
@@ -33,7 +83,23 @@ func New(cfg Config) (*S3GzipCloud, error) {
 		return nil, errors.Errorf("Bucket is required")
 	}
 
-	u := &S3GzipCloud{cfg: cfg}
+	if (cfg.Id == "") != (cfg.Secret == "") {
+		return nil, errors.Errorf("Id and Secret must be given together")
+	}
+
+	if cfg.SSEKMSKeyID != "" && cfg.ServerSideEncryption == "" {
+		cfg.ServerSideEncryption = s3.ServerSideEncryptionAwsKms
+	}
+
+	if cfg.SSEKMSKeyID != "" && cfg.ServerSideEncryption != s3.ServerSideEncryptionAwsKms {
+		return nil, errors.Errorf("SSEKMSKeyID requires %s server side encryption", s3.ServerSideEncryptionAwsKms)
+	}
+
+	if cfg.ObjectLockMode != "" && cfg.ObjectLockRetention <= 0 {
+		return nil, errors.Errorf("ObjectLockRetention is required for object lock mode %s", cfg.ObjectLockMode)
+	}
+
+	u := &S3GzipCloud{cfg: cfg, keys: newKeyLayout(cfg)}
 	if err := u.connect(); err != nil {
 		return nil, err
 	}
@@ -41,24 +107,40 @@ func New(cfg Config) (*S3GzipCloud, error) {
 	return u, nil
 }
 
+// connect uses static keys when they are given, otherwise credentials are looked up
+// by the default provider chain: environment variables, shared credentials and config
+// files, web identity and EC2 or ECS roles
 func (u *S3GzipCloud) connect() error {
 	cfg := aws.Config{
-		Region:           aws.String(u.cfg.Region),
-		Endpoint:         aws.String(u.cfg.Endpoint),
 		S3ForcePathStyle: aws.Bool(true),
-		Credentials:      credentials.NewStaticCredentials(u.cfg.Id, u.cfg.Secret, ""),
 		//LogLevel:         &ll,
 	}
 
+	if u.cfg.Region != "" {
+		cfg.Region = aws.String(u.cfg.Region)
+	}
+
+	if u.cfg.Endpoint != "" {
+		cfg.Endpoint = aws.String(u.cfg.Endpoint)
+	}
+
+	if u.cfg.Id != "" {
+		cfg.Credentials = credentials.NewStaticCredentials(u.cfg.Id, u.cfg.Secret, u.cfg.SessionToken)
+	}
+
 	if u.cfg.NoSSL {
 		cfg.DisableSSL = aws.Bool(true)
 	}
 
 	//ll := aws.LogDebugWithHTTPBody | aws.LogDebugWithSigning
-	s, err := session.NewSession(&cfg)
+	s, err := session.NewSessionWithOptions(session.Options{
+		Config:            cfg,
+		Profile:           u.cfg.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
 
 	if err != nil {
-		return errors.Wrapf(err, "could not connect to %s", "http://127.0.0.1:9001")
+		return opError(OpConnect, "", "", errors.Wrapf(err, "could not connect to %s", u.endpoint()))
 	}
 
 	u.s = s
@@ -66,7 +148,40 @@ func (u *S3GzipCloud) connect() error {
 	return nil
 }
 
+func (u *S3GzipCloud) endpoint() string {
+	if u.cfg.Endpoint != "" {
+		return u.cfg.Endpoint
+	}
+
+	return "S3"
+}
+
+// Upload computes the checksums of the file and uploads it, see UploadWithChecksum
 func (u *S3GzipCloud) Upload(fp string) error {
+	return u.UploadWithContext(aws.BackgroundContext(), fp)
+}
+
+// UploadWithContext is Upload which gives up once ctx is done
+func (u *S3GzipCloud) UploadWithContext(ctx context.Context, fp string) error {
+	md5sum, sha256sum, err := fileChecksums(fp)
+	if err != nil {
+		return err
+	}
+
+	return u.UploadWithChecksumContext(ctx, fp, md5sum, sha256sum)
+}
+
+// UploadWithChecksum uploads the file and makes sure the stored object matches the checksums:
+// S3 rejects single part uploads not matching the MD5, the ETag and the SHA-256 kept
+// in the object metadata are checked once the upload is complete. Files stored already
+// are not uploaded again.
+func (u *S3GzipCloud) UploadWithChecksum(fp string, md5sum, sha256sum []byte) error {
+	return u.UploadWithChecksumContext(aws.BackgroundContext(), fp, md5sum, sha256sum)
+}
+
+// UploadWithChecksumContext is UploadWithChecksum which gives up once ctx is done,
+// requests to S3 in progress are cancelled
+func (u *S3GzipCloud) UploadWithChecksumContext(ctx context.Context, fp string, md5sum, sha256sum []byte) error {
 	if u.s == nil {
 		if err := u.connect(); err != nil {
 			return err
@@ -75,24 +190,185 @@ func (u *S3GzipCloud) Upload(fp string) error {
 
 	f, err := os.Open(fp)
 	if err != nil {
-		return errors.Wrapf(err, "could not open %s to upload to the cloud", fp)
+		return opError(OpUpload, "", fp, errors.Wrapf(err, "could not open %s to upload to the cloud", fp))
 	}
 
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return opError(OpUpload, "", fp, errors.Wrapf(err, "could not read stats of %s to upload to the cloud", fp))
+	}
+
+	date := fileDateOf(fp, fi.ModTime())
+	svc := s3.New(u.s)
+
 	// Create an uploader with the session and default options
 	up := s3manager.NewUploader(u.s)
 
-	_, err = up.Upload(&s3manager.UploadInput{
-		Bucket:          aws.String(u.cfg.Bucket),
-		Key:             aws.String(filepath.Base(f.Name())),
-		Body:            f,
-		ContentType:     aws.String(logFileContentType),
-		ContentEncoding: aws.String(logFileContentEncoding),
-		ACL:             aws.String(u.cfg.Acl),
+	key := u.keys.key(fp, date)
+
+	if !u.cfg.WriteOnly {
+		var uploaded bool
+		key, uploaded, err = u.target(ctx, svc, fp, key, fi.Size(), up.PartSize, md5sum, sha256sum)
+		if err != nil || uploaded {
+			return err
+		}
+	}
+
+	input := u.uploadInput(fp, key, date)
+	input.Body = f
+	input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(md5sum))
+
+	if input.Metadata == nil {
+		input.Metadata = make(map[string]*string)
+	}
+
+	input.Metadata[checksumMetadata] = aws.String(hex.EncodeToString(sha256sum))
+
+	out, err := up.UploadWithContext(ctx, input)
+
+	if err != nil {
+		return opError(OpUpload, key, fp, errors.Wrapf(err, "could not put object %s to S3", key))
+	}
+
+	if u.cfg.WriteOnly {
+		return nil
+	}
+
+	etag := hex.EncodeToString(md5sum)
+	if out.UploadID != "" {
+		if etag, err = multipartETag(fp, uploadPartSize(fi.Size(), up.PartSize)); err != nil {
+			return err
+		}
+	}
+
+	head, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(u.cfg.Bucket),
+		Key:    aws.String(key),
 	})
 
 	if err != nil {
-		return errors.Wrapf(err, "could not put object %s to S3", "testfile.gz")
+		return opError(OpVerify, key, fp, errors.Wrapf(err, "could not verify object %s", key))
+	}
+
+	if err := matches(head, etag, sha256sum); err != nil {
+		return opError(OpVerify, key, fp, errors.Wrapf(err, "object %s does not match %s", key, fp))
 	}
 
 	return nil
 }
+
+// target returns the key to upload the file to, or tells that the file was uploaded already,
+// e.g. by a run which stopped before removing the file. A different object stored under
+// the key is not overwritten, the file goes to a key made unique by its checksum instead.
+func (u *S3GzipCloud) target(
+	ctx context.Context,
+	svc *s3.S3,
+	fp, key string,
+	size, partSize int64,
+	md5sum, sha256sum []byte,
+) (string, bool, error) {
+	for _, candidate := range []string{key, collisionKey(key, sha256sum)} {
+		head, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(u.cfg.Bucket),
+			Key:    aws.String(candidate),
+		})
+
+		if isNotFound(err) {
+			return candidate, false, nil
+		}
+
+		if isForbidden(err) {
+			return "", false, opError(OpUpload, candidate, fp, errors.Wrapf(err, "could not look up object %s, s3:GetObject and s3:ListBucket are needed unless WriteOnly is set", candidate))
+		}
+
+		if err != nil {
+			return "", false, opError(OpUpload, candidate, fp, errors.Wrapf(err, "could not look up object %s", candidate))
+		}
+
+		etag, err := expectedETag(fp, head, size, partSize, md5sum)
+		if err != nil {
+			return "", false, err
+		}
+
+		if matches(head, etag, sha256sum) == nil {
+			return candidate, true, nil
+		}
+	}
+
+	// the object named after the checksum differs from the file only if it is broken
+	return collisionKey(key, sha256sum), false, nil
+}
+
+func isNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// isForbidden tells about missing permissions, S3 answers 403 instead of 404
+// for missing objects if s3:ListBucket is not allowed
+func isForbidden(err error) bool {
+	return hasStatus(err, http.StatusForbidden)
+}
+
+func hasStatus(err error, status int) bool {
+	if rf, ok := err.(awserr.RequestFailure); ok {
+		return rf.StatusCode() == status
+	}
+
+	return false
+}
+
+// uploadInput describes the object the file is uploaded as
+func (u *S3GzipCloud) uploadInput(fp, key string, date time.Time) *s3manager.UploadInput {
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String(u.cfg.Bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(logFileContentType),
+		ACL:         aws.String(u.cfg.Acl),
+	}
+
+	// the encoding follows the codec the file was compressed with
+	if c, ok := codec.ByExtension(fp); ok {
+		input.ContentEncoding = aws.String(c.Encoding())
+	}
+
+	if u.cfg.StorageClass != "" {
+		input.StorageClass = aws.String(u.cfg.StorageClass)
+	}
+
+	if u.cfg.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(u.cfg.ServerSideEncryption)
+	}
+
+	if u.cfg.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(u.cfg.SSEKMSKeyID)
+	}
+
+	if len(u.cfg.Tags) > 0 {
+		tags := url.Values{}
+		for k, v := range u.cfg.Tags {
+			tags.Set(k, u.keys.expand(v, fp, date))
+		}
+
+		input.Tagging = aws.String(tags.Encode())
+	}
+
+	if len(u.cfg.Metadata) > 0 {
+		input.Metadata = make(map[string]*string, len(u.cfg.Metadata))
+		for k, v := range u.cfg.Metadata {
+			input.Metadata[k] = aws.String(u.keys.expand(v, fp, date))
+		}
+	}
+
+	if u.cfg.ObjectLockMode != "" {
+		input.ObjectLockMode = aws.String(u.cfg.ObjectLockMode)
+		input.ObjectLockRetainUntilDate = aws.Time(time.Now().Add(u.cfg.ObjectLockRetention))
+	}
+
+	if u.cfg.ObjectLockLegalHold {
+		input.ObjectLockLegalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+
+	return input
+}
@@ -0,0 +1,140 @@
+package cloud
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadInput(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		u, err := New(Config{Bucket: "logs", Acl: "private", Host: "web-1"})
+		require.NoError(t, err)
+
+		input := u.uploadInput("/var/log/app-2020-10-11.1.log.gz", "app-2020-10-11.1.log.gz", time.Now())
+
+		assert.Equal(t, "logs", aws.StringValue(input.Bucket))
+		assert.Equal(t, "gzip", aws.StringValue(input.ContentEncoding))
+		assert.Nil(t, input.StorageClass)
+		assert.Nil(t, input.ServerSideEncryption)
+		assert.Nil(t, input.Tagging)
+		assert.Nil(t, input.Metadata)
+		assert.Nil(t, input.ObjectLockMode)
+		assert.Nil(t, input.ObjectLockLegalHoldStatus)
+	})
+
+	t.Run("compliance options", func(t *testing.T) {
+		u, err := New(Config{
+			Bucket:              "logs",
+			Host:                "web-1",
+			StorageClass:        "STANDARD_IA",
+			SSEKMSKeyID:         "key-1",
+			Tags:                map[string]string{"app": "billing", "host": "{host}"},
+			Metadata:            map[string]string{"date": "{year}-{month}-{day}"},
+			ObjectLockMode:      "COMPLIANCE",
+			ObjectLockRetention: 24 * time.Hour,
+			ObjectLockLegalHold: true,
+		})
+
+		require.NoError(t, err)
+
+		date := time.Date(2020, time.October, 11, 0, 0, 0, 0, time.UTC)
+		input := u.uploadInput("/var/log/app-2020-10-11.1.log.gz", "app-2020-10-11.1.log.gz", date)
+
+		assert.Equal(t, "STANDARD_IA", aws.StringValue(input.StorageClass))
+		assert.Equal(t, "aws:kms", aws.StringValue(input.ServerSideEncryption))
+		assert.Equal(t, "key-1", aws.StringValue(input.SSEKMSKeyId))
+
+		tags, err := url.ParseQuery(aws.StringValue(input.Tagging))
+		require.NoError(t, err)
+		assert.Equal(t, "billing", tags.Get("app"))
+		assert.Equal(t, "web-1", tags.Get("host"))
+
+		assert.Equal(t, "2020-10-11", aws.StringValue(input.Metadata["date"]))
+
+		assert.Equal(t, "COMPLIANCE", aws.StringValue(input.ObjectLockMode))
+		assert.WithinDuration(t, time.Now().Add(24*time.Hour), aws.TimeValue(input.ObjectLockRetainUntilDate), time.Minute)
+		assert.Equal(t, "ON", aws.StringValue(input.ObjectLockLegalHoldStatus))
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		_, err := New(Config{Bucket: "logs", SSEKMSKeyID: "key-1", ServerSideEncryption: "AES256"})
+		assert.Error(t, err)
+
+		_, err = New(Config{Bucket: "logs", ObjectLockMode: "GOVERNANCE"})
+		assert.Error(t, err)
+	})
+}
+
+func TestCredentials(t *testing.T) {
+	setenv := func(t *testing.T, key, value string) {
+		prev, ok := os.LookupEnv(key)
+		require.NoError(t, os.Setenv(key, value))
+
+		t.Cleanup(func() {
+			if ok {
+				_ = os.Setenv(key, prev)
+			} else {
+				_ = os.Unsetenv(key)
+			}
+		})
+	}
+
+	t.Run("static keys with a session token", func(t *testing.T) {
+		u, err := New(Config{Bucket: "logs", Region: "us-east-1", Id: "id", Secret: "secret", SessionToken: "token"})
+		require.NoError(t, err)
+
+		v, err := u.s.Config.Credentials.Get()
+		require.NoError(t, err)
+		assert.Equal(t, "id", v.AccessKeyID)
+		assert.Equal(t, "secret", v.SecretAccessKey)
+		assert.Equal(t, "token", v.SessionToken)
+	})
+
+	t.Run("environment", func(t *testing.T) {
+		setenv(t, "AWS_ACCESS_KEY_ID", "env-id")
+		setenv(t, "AWS_SECRET_ACCESS_KEY", "env-secret")
+		setenv(t, "AWS_SESSION_TOKEN", "env-token")
+
+		u, err := New(Config{Bucket: "logs", Region: "us-east-1"})
+		require.NoError(t, err)
+
+		v, err := u.s.Config.Credentials.Get()
+		require.NoError(t, err)
+		assert.Equal(t, "env-id", v.AccessKeyID)
+		assert.Equal(t, "env-token", v.SessionToken)
+	})
+
+	t.Run("shared credentials profile", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "juggler-credentials")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		file := filepath.Join(dir, "credentials")
+		content := "[ci]\naws_access_key_id = profile-id\naws_secret_access_key = profile-secret\n"
+		require.NoError(t, ioutil.WriteFile(file, []byte(content), 0600))
+
+		setenv(t, "AWS_ACCESS_KEY_ID", "")
+		setenv(t, "AWS_SECRET_ACCESS_KEY", "")
+		setenv(t, "AWS_SHARED_CREDENTIALS_FILE", file)
+		setenv(t, "AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+
+		u, err := New(Config{Bucket: "logs", Region: "us-east-1", Profile: "ci"})
+		require.NoError(t, err)
+
+		v, err := u.s.Config.Credentials.Get()
+		require.NoError(t, err)
+		assert.Equal(t, "profile-id", v.AccessKeyID)
+	})
+
+	t.Run("incomplete static keys", func(t *testing.T) {
+		_, err := New(Config{Bucket: "logs", Id: "id"})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,52 @@
+package cloud
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Op names the operation which failed
+type Op string
+
+const (
+	OpConnect  Op = "connect"
+	OpUpload   Op = "upload"
+	OpVerify   Op = "verify"
+	OpList     Op = "list"
+	OpDownload Op = "download"
+)
+
+// ErrChecksumMismatch is the cause of errors of objects not matching the uploaded files
+var ErrChecksumMismatch = errors.New("stored object does not match the file")
+
+// Error is returned by S3GzipCloud, errors.Is and errors.As find the cause as well
+type Error struct {
+	Op   Op
+	Key  string
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return "s3 " + string(e.Op) + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Cause makes errors.Cause of github.com/pkg/errors find the cause
+func (e *Error) Cause() error {
+	return e.Err
+}
+
+func opError(op Op, key, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+
+	return &Error{Op: op, Key: key, Path: path, Err: err}
+}
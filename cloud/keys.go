@@ -0,0 +1,289 @@
+package cloud
+
+import (
+	"github.com/denismitr/juggler/codec"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultKeyTemplate keeps the name of the file as the object key
+const DefaultKeyTemplate = "{filename}"
+
+// defaultFilenameTemplate is the default filename template of juggler
+const defaultFilenameTemplate = "{prefix}-{date}.{version}.log"
+
+// HiveKeyTemplate partitions objects by date, so that they can be queried
+// by tools like Athena, and keeps files of different instances apart,
+// e.g. year=2020/month=10/day=11/web-1/my-log-2020-10-11.1.log.gz
+const HiveKeyTemplate = "year={year}/month={month}/day={day}/{instance}/{filename}"
+
+var (
+	keyToken = regexp.MustCompile(`\{(\w+)\}`)
+
+	// dates of rotated files as they appear in the default and the nested file names,
+	// e.g. 2020-10-11, 2020-10-11T15-04 or 2020/10/11
+	fileDate = regexp.MustCompile(`(\d{4})[-/](\d{2})[-/](\d{2})(?:T(\d{2}))?`)
+)
+
+// keyLayout builds object keys from the paths of uploaded files
+type keyLayout struct {
+	prefix   string
+	template string
+	host     string
+	instance string
+
+	// names is the filename template of the log files, depth
+	// tells how many path elements their names consist of
+	names string
+	depth int
+}
+
+func newKeyLayout(cfg Config) keyLayout {
+	l := keyLayout{
+		prefix:   strings.Trim(cfg.KeyPrefix, "/"),
+		template: cfg.KeyTemplate,
+		host:     cfg.Host,
+		instance: cfg.InstanceID,
+		names:    strings.Trim(cfg.FilenameTemplate, "/"),
+	}
+
+	if l.template == "" {
+		l.template = DefaultKeyTemplate
+	}
+
+	if l.names == "" {
+		l.names = defaultFilenameTemplate
+	}
+
+	l.depth = strings.Count(l.names, "/") + 1
+
+	if l.host == "" {
+		if host, err := os.Hostname(); err == nil {
+			l.host = host
+		} else {
+			l.host = "localhost"
+		}
+	}
+
+	if l.instance == "" {
+		l.instance = l.host
+	}
+
+	return l
+}
+
+// key returns the object key of the file dated by fileDateOf
+func (l keyLayout) key(fp string, date time.Time) string {
+	key := l.expand(l.template, fp, date)
+
+	if l.prefix == "" {
+		return key
+	}
+
+	return path.Join(l.prefix, key)
+}
+
+// listPrefix returns the beginning the keys of log files named with the prefix have in common
+func (l keyLayout) listPrefix(prefix string) string {
+	static := staticPart(l.template)
+
+	if strings.HasPrefix(l.template[len(static):], "{filename}") {
+		static += staticPart(strings.Replace(l.names, "{prefix}", prefix, -1))
+	}
+
+	if l.prefix == "" {
+		return static
+	}
+
+	return l.prefix + "/" + static
+}
+
+// staticPart returns the beginning of the template which holds no tokens
+func staticPart(template string) string {
+	if i := strings.Index(template, "{"); i >= 0 {
+		return template[:i]
+	}
+
+	return template
+}
+
+// keyMatcher tells the keys of log files named with a prefix from other keys
+type keyMatcher struct {
+	keys     *regexp.Regexp
+	names    *regexp.Regexp
+	filename func(key string) string
+
+	// tokens captured by names, in the order of the groups
+	tokens []string
+}
+
+// matcher matches the keys of the log files named with the prefix, as laid out by the
+// key template, the names of the files as laid out by their filename template
+func (l keyLayout) matcher(prefix string) keyMatcher {
+	keyTemplate := l.template
+	if l.prefix != "" {
+		keyTemplate = l.prefix + "/" + keyTemplate
+	}
+
+	keys, _ := templatePattern(keyTemplate, map[string]string{
+		"filename": `.+`,
+		"host":     `[^/]+`,
+		"instance": `[^/]+`,
+		"year":     `\d{4}`,
+		"month":    `\d{2}`,
+		"day":      `\d{2}`,
+		"hour":     `\d{2}`,
+	})
+
+	names, tokens := templatePattern(l.names, map[string]string{
+		"prefix":  regexp.QuoteMeta(prefix),
+		"host":    `[^/]+`,
+		"date":    `\d{4}-\d{2}-\d{2}(?:T\d{2}(?:-\d{2})?)?`,
+		"yyyy":    `\d{4}`,
+		"mm":      `\d{2}`,
+		"dd":      `\d{2}`,
+		"HH":      `\d{2}`,
+		"MM":      `\d{2}`,
+		"version": `\d+`,
+	})
+
+	return keyMatcher{keys: keys, names: names, filename: l.filename, tokens: tokens}
+}
+
+// match tells whether the key belongs to a log file and returns the date
+// its name holds, a zero time if the name holds none
+func (m keyMatcher) match(key string) (time.Time, bool) {
+	if !m.keys.MatchString(key) {
+		return time.Time{}, false
+	}
+
+	name := m.filename(key)
+	if c, ok := codec.ByExtension(name); ok {
+		name = strings.TrimSuffix(name, c.Extension())
+	}
+
+	// files which collided with other objects carry a checksum in their keys
+	for _, candidate := range []string{name, collisionSuffix.ReplaceAllString(name, "$1")} {
+		if values := m.names.FindStringSubmatch(candidate); values != nil {
+			return m.dateOf(values[1:]), true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+func (m keyMatcher) dateOf(values []string) time.Time {
+	parts := make(map[string]string)
+	for i, token := range m.tokens {
+		parts[token] = values[i]
+	}
+
+	if d, ok := parts["date"]; ok {
+		for _, layout := range []string{"2006-01-02T15-04", "2006-01-02T15", "2006-01-02"} {
+			if t, err := time.Parse(layout, d); err == nil {
+				return t
+			}
+		}
+	}
+
+	if _, ok := parts["yyyy"]; !ok {
+		return time.Time{}
+	}
+
+	number := func(token string, missing int) int {
+		if v, err := strconv.Atoi(parts[token]); err == nil {
+			return v
+		}
+
+		return missing
+	}
+
+	return time.Date(number("yyyy", 0), time.Month(number("mm", 1)), number("dd", 1), number("HH", 0), number("MM", 0), 0, 0, time.UTC)
+}
+
+// templatePattern turns a template into an anchored regular expression, every token
+// is captured by the pattern given for it, other tokens are matched literally
+func templatePattern(template string, patterns map[string]string) (*regexp.Regexp, []string) {
+	var b strings.Builder
+	var tokens []string
+
+	b.WriteString("^")
+
+	last := 0
+	for _, loc := range keyToken.FindAllStringSubmatchIndex(template, -1) {
+		b.WriteString(regexp.QuoteMeta(template[last:loc[0]]))
+
+		token := template[loc[2]:loc[3]]
+		if p, ok := patterns[token]; ok {
+			b.WriteString("(" + p + ")")
+			tokens = append(tokens, token)
+		} else {
+			b.WriteString(regexp.QuoteMeta(template[loc[0]:loc[1]]))
+		}
+
+		last = loc[1]
+	}
+
+	b.WriteString(regexp.QuoteMeta(template[last:]) + "$")
+
+	return regexp.MustCompile(b.String()), tokens
+}
+
+// expand replaces the tokens of the template with the values describing the file
+func (l keyLayout) expand(template, fp string, date time.Time) string {
+	return keyToken.ReplaceAllStringFunc(template, func(token string) string {
+		switch token[1 : len(token)-1] {
+		case "filename":
+			return l.filename(fp)
+		case "host":
+			return l.host
+		case "instance":
+			return l.instance
+		case "year":
+			return date.Format("2006")
+		case "month":
+			return date.Format("01")
+		case "day":
+			return date.Format("02")
+		case "hour":
+			return date.Format("15")
+		default:
+			return token
+		}
+	})
+}
+
+// filename returns the name of the file relative to the log directory, the last
+// path elements of fp, as many as the filename template of the log files has
+func (l keyLayout) filename(fp string) string {
+	elems := strings.Split(filepath.ToSlash(fp), "/")
+	if len(elems) > l.depth {
+		elems = elems[len(elems)-l.depth:]
+	}
+
+	return strings.Join(elems, "/")
+}
+
+// fileDateOf returns the date in the file name, or the time the file
+// was last modified if there is none
+func fileDateOf(fp string, modTime time.Time) time.Time {
+	m := fileDate.FindAllStringSubmatch(filepath.ToSlash(fp), -1)
+	if m == nil {
+		return modTime.UTC()
+	}
+
+	// the date closest to the file name wins over dates in directory names
+	last := m[len(m)-1]
+
+	year, _ := strconv.Atoi(last[1])
+	month, _ := strconv.Atoi(last[2])
+	day, _ := strconv.Atoi(last[3])
+	hour, _ := strconv.Atoi(last[4])
+
+	return time.Date(year, time.Month(month), day, hour, 0, 0, 0, time.UTC)
+}
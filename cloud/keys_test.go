@@ -0,0 +1,73 @@
+package cloud
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestKeyLayout(t *testing.T) {
+	modTime := time.Date(2021, time.March, 4, 5, 6, 7, 0, time.UTC)
+
+	tt := []struct {
+		name string
+		cfg  Config
+		path string
+		key  string
+	}{
+		{
+			name: "default",
+			cfg:  Config{Host: "web-1"},
+			path: "/var/log/app/my-log-2020-10-11.1.log.gz",
+			key:  "my-log-2020-10-11.1.log.gz",
+		},
+		{
+			name: "static prefix",
+			cfg:  Config{KeyPrefix: "/logs/app/", Host: "web-1"},
+			path: "/var/log/app/my-log-2020-10-11.1.log.gz",
+			key:  "logs/app/my-log-2020-10-11.1.log.gz",
+		},
+		{
+			name: "hive partitions with the host",
+			cfg:  Config{KeyPrefix: "logs", KeyTemplate: HiveKeyTemplate, Host: "web-1"},
+			path: "/var/log/app/my-log-2020-10-11.1.log.gz",
+			key:  "logs/year=2020/month=10/day=11/web-1/my-log-2020-10-11.1.log.gz",
+		},
+		{
+			name: "hourly partitions with the instance",
+			cfg:  Config{KeyTemplate: "{year}/{month}/{day}/{hour}/{host}-{instance}/{filename}", Host: "web-1", InstanceID: "i-123"},
+			path: "/var/log/app/my-log-2020-10-11T15.2.log.zst",
+			key:  "2020/10/11/15/web-1-i-123/my-log-2020-10-11T15.2.log.zst",
+		},
+		{
+			name: "date from nested directories",
+			cfg:  Config{KeyTemplate: HiveKeyTemplate, Host: "web-1"},
+			path: "/var/log/app/2020/10/11/web-1-3.jsonl.gz",
+			key:  "year=2020/month=10/day=11/web-1/web-1-3.jsonl.gz",
+		},
+		{
+			name: "nested filename template",
+			cfg:  Config{FilenameTemplate: "{prefix}/{yyyy}/{mm}/{dd}/{host}-{version}.jsonl", Host: "web-1"},
+			path: "/var/log/app/my-log/2020/10/12/web-1-1.jsonl.gz",
+			key:  "my-log/2020/10/12/web-1-1.jsonl.gz",
+		},
+		{
+			name: "nested filename template with hive partitions",
+			cfg:  Config{KeyTemplate: HiveKeyTemplate, FilenameTemplate: "{prefix}/{yyyy}/{mm}/{dd}/{host}-{version}.jsonl", Host: "web-1"},
+			path: "/var/log/app/my-log/2020/10/11/web-1-1.jsonl.gz",
+			key:  "year=2020/month=10/day=11/web-1/my-log/2020/10/11/web-1-1.jsonl.gz",
+		},
+		{
+			name: "date from modification time",
+			cfg:  Config{KeyTemplate: HiveKeyTemplate, Host: "web-1"},
+			path: "/var/log/app/custom.log.gz",
+			key:  "year=2021/month=03/day=04/web-1/custom.log.gz",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.key, newKeyLayout(tc.cfg).key(tc.path, fileDateOf(tc.path, modTime)))
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package cloud
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/denismitr/juggler/codec"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// collisionSuffix matches the checksum added to keys of files which collided with other objects
+var collisionSuffix = regexp.MustCompile(`\.[0-9a-f]{12}(\.[^.]+)$`)
+
+// Archive is a log file stored in the bucket
+type Archive struct {
+	Key  string
+	Date time.Time
+	Size int64
+}
+
+// List returns the archives of log files named with the prefix and dated from the day of from
+// to the day of to, both days included, ordered by date. Keys are matched as laid out by KeyTemplate, names of
+// the files by FilenameTemplate, dates come from the names or else from the keys.
+func (u *S3GzipCloud) List(prefix string, from, to time.Time) ([]Archive, error) {
+	if u.s == nil {
+		if err := u.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	var result []Archive
+
+	m := u.keys.matcher(prefix)
+
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(u.cfg.Bucket),
+		Prefix: aws.String(u.keys.listPrefix(prefix)),
+	}
+
+	err := s3.New(u.s).ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, o := range page.Contents {
+			key := aws.StringValue(o.Key)
+
+			date, ok := m.match(key)
+			if !ok {
+				continue
+			}
+
+			if date.IsZero() {
+				date = fileDateOf(key, aws.TimeValue(o.LastModified))
+			}
+			if d := dayOf(date); d.Before(dayOf(from)) || d.After(dayOf(to)) {
+				continue
+			}
+
+			result = append(result, Archive{Key: key, Date: date, Size: aws.Int64Value(o.Size)})
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return nil, opError(OpList, u.keys.listPrefix(prefix), "", errors.Wrapf(err, "could not list objects of %s in bucket %s", prefix, u.cfg.Bucket))
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Date.Equal(result[j].Date) {
+			return result[i].Key < result[j].Key
+		}
+
+		return result[i].Date.Before(result[j].Date)
+	})
+
+	return result, nil
+}
+
+// dayOf returns the calendar day of t, so that files rotated more often
+// than daily are listed for all of their day
+func dayOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Download fetches the archive into the directory and returns the path of the local file,
+// files named by nested templates are put into subdirectories as in the log directory.
+// If decompress is set, archives compressed by a builtin codec are decompressed into files
+// with the original names of the log files.
+func (u *S3GzipCloud) Download(a Archive, dir string, decompress bool) (string, error) {
+	if u.s == nil {
+		if err := u.connect(); err != nil {
+			return "", err
+		}
+	}
+
+	name := u.keys.filename(a.Key)
+
+	sub := filepath.Dir(filepath.Join(dir, filepath.FromSlash(name)))
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		return "", opError(OpDownload, a.Key, sub, errors.Wrapf(err, "cannot create directory %s", sub))
+	}
+
+	// the content encoding of the objects must not be undone by the http client
+	out, err := s3.New(u.s).GetObjectWithContext(aws.BackgroundContext(), &s3.GetObjectInput{
+		Bucket: aws.String(u.cfg.Bucket),
+		Key:    aws.String(a.Key),
+	}, request.WithSetRequestHeaders(map[string]string{"Accept-Encoding": "identity"}))
+
+	if err != nil {
+		return "", opError(OpDownload, a.Key, "", errors.Wrapf(err, "could not get object %s from S3", a.Key))
+	}
+
+	defer out.Body.Close()
+
+	var body io.Reader = out.Body
+
+	if c, ok := codec.ByExtension(name); ok && decompress {
+		if d, ok := c.(codec.Decompressor); ok {
+			r, err := d.NewReader(out.Body)
+			if err != nil {
+				return "", opError(OpDownload, a.Key, "", errors.Wrapf(err, "could not decompress object %s", a.Key))
+			}
+
+			defer r.Close()
+
+			body = r
+			name = originalName(dir, strings.TrimSuffix(name, c.Extension()))
+		}
+	}
+
+	dst := filepath.Join(dir, filepath.FromSlash(name))
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".tmp")
+	if err != nil {
+		return "", opError(OpDownload, a.Key, dst, errors.Wrapf(err, "could not create file %s", dst))
+	}
+
+	_, err = io.Copy(tmp, body)
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", opError(OpDownload, a.Key, dst, errors.Wrapf(err, "could not download object %s to %s", a.Key, dst))
+	}
+
+	return dst, nil
+}
+
+// Restore downloads the archives of log files named with the prefix and dated from the day of from
+// to the day of to, see List and Download. It returns the paths of the files downloaded, also when it fails midway.
+func (u *S3GzipCloud) Restore(prefix string, from, to time.Time, dir string, decompress bool) ([]string, error) {
+	archives, err := u.List(prefix, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// files which collided with others are restored under their original names
+	// only if the others are not, so the others go first
+	sort.SliceStable(archives, func(i, j int) bool {
+		return !collided(archives[i].Key) && collided(archives[j].Key)
+	})
+
+	var result []string
+
+	for _, a := range archives {
+		fp, err := u.Download(a, dir, decompress)
+		if err != nil {
+			return result, err
+		}
+
+		result = append(result, fp)
+	}
+
+	return result, nil
+}
+
+func collided(key string) bool {
+	if c, ok := codec.ByExtension(key); ok {
+		key = strings.TrimSuffix(key, c.Extension())
+	}
+
+	return collisionSuffix.MatchString(key)
+}
+
+// originalName drops the checksum added to the key of a file which collided with another
+// object, unless the file the other object was restored to would be overwritten
+func originalName(dir, name string) string {
+	original := collisionSuffix.ReplaceAllString(name, "$1")
+	if original == name {
+		return name
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(original))); err == nil {
+		return name
+	}
+
+	return original
+}
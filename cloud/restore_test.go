@@ -0,0 +1,252 @@
+package cloud
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestore(t *testing.T) {
+	src, err := ioutil.TempDir("", "juggler-archives")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+
+	s, srv := newFakeS3()
+	defer srv.Close()
+
+	u, err := New(Config{
+		Bucket:      "logs",
+		Region:      "us-east-1",
+		Id:          "id",
+		Secret:      "secret",
+		Endpoint:    srv.URL,
+		NoSSL:       true,
+		KeyPrefix:   "my-app",
+		KeyTemplate: HiveKeyTemplate,
+		Host:        "web-1",
+	})
+
+	require.NoError(t, err)
+
+	archive := func(name, content string) {
+		fp := filepath.Join(src, name)
+		require.NoError(t, ioutil.WriteFile(fp, gzipped(t, content), 0600))
+		require.NoError(t, u.Upload(fp))
+	}
+
+	archive("app-2020-10-10.1.log.gz", "10th")
+	archive("app-2020-10-11.1.log.gz", "11th, first")
+	archive("app-2020-10-11.2.log.gz", "11th, second")
+	archive("app-2020-10-12.1.log.gz", "12th")
+	archive("other-2020-10-11.1.log.gz", "other app")
+
+	// a different file of the same name went next to the stored one
+	s.put("logs/my-app/year=2020/month=10/day=12/web-1/app-2020-10-12.1.0123456789ab.log.gz", gzipped(t, "12th, again"), nil)
+
+	from := time.Date(2020, time.October, 11, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2020, time.October, 12, 0, 0, 0, 0, time.UTC)
+
+	t.Run("list", func(t *testing.T) {
+		archives, err := u.List("app", from, to)
+		require.NoError(t, err)
+
+		var keys []string
+		for _, a := range archives {
+			keys = append(keys, a.Key)
+		}
+
+		assert.Equal(t, []string{
+			"my-app/year=2020/month=10/day=11/web-1/app-2020-10-11.1.log.gz",
+			"my-app/year=2020/month=10/day=11/web-1/app-2020-10-11.2.log.gz",
+			"my-app/year=2020/month=10/day=12/web-1/app-2020-10-12.1.0123456789ab.log.gz",
+			"my-app/year=2020/month=10/day=12/web-1/app-2020-10-12.1.log.gz",
+		}, keys)
+
+		assert.Equal(t, from, archives[0].Date)
+	})
+
+	t.Run("restore compressed", func(t *testing.T) {
+		dst, err := ioutil.TempDir("", "juggler-restore")
+		require.NoError(t, err)
+		defer os.RemoveAll(dst)
+
+		files, err := u.Restore("app", from, from, dst, false)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{
+			filepath.Join(dst, "app-2020-10-11.1.log.gz"),
+			filepath.Join(dst, "app-2020-10-11.2.log.gz"),
+		}, files)
+
+		b, err := ioutil.ReadFile(files[0])
+		require.NoError(t, err)
+		assert.Equal(t, gzipped(t, "11th, first"), b)
+	})
+
+	t.Run("restore decompressed", func(t *testing.T) {
+		dst, err := ioutil.TempDir("", "juggler-restore")
+		require.NoError(t, err)
+		defer os.RemoveAll(dst)
+
+		files, err := u.Restore("app", from, to, dst, true)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{
+			filepath.Join(dst, "app-2020-10-11.1.log"),
+			filepath.Join(dst, "app-2020-10-11.2.log"),
+			filepath.Join(dst, "app-2020-10-12.1.log"),
+			filepath.Join(dst, "app-2020-10-12.1.0123456789ab.log"),
+		}, files)
+
+		for fp, content := range map[string]string{
+			files[0]: "11th, first",
+			files[1]: "11th, second",
+			files[2]: "12th",
+			files[3]: "12th, again",
+		} {
+			b, err := ioutil.ReadFile(fp)
+			require.NoError(t, err)
+			assert.Equal(t, content, string(b))
+		}
+	})
+}
+
+func TestRestoreNested(t *testing.T) {
+	src, err := ioutil.TempDir("", "juggler-archives")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+
+	_, srv := newFakeS3()
+	defer srv.Close()
+
+	u, err := New(Config{
+		Bucket:           "logs",
+		Region:           "us-east-1",
+		Id:               "id",
+		Secret:           "secret",
+		Endpoint:         srv.URL,
+		NoSSL:            true,
+		KeyPrefix:        "my-app",
+		FilenameTemplate: "{prefix}/{yyyy}/{mm}/{dd}/{host}-{version}.jsonl",
+		Host:             "web-1",
+	})
+
+	require.NoError(t, err)
+
+	archive := func(name, content string) {
+		fp := filepath.Join(src, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(fp), 0755))
+		require.NoError(t, ioutil.WriteFile(fp, gzipped(t, content), 0600))
+		require.NoError(t, u.Upload(fp))
+	}
+
+	archive("app/2020/10/10/web-1-1.jsonl.gz", "10th")
+	archive("app/2020/10/11/web-1-1.jsonl.gz", "11th, first")
+	archive("app/2020/10/11/web-1-2.jsonl.gz", "11th, second")
+	archive("app/2020/10/12/web-1-1.jsonl.gz", "12th")
+	archive("other/2020/10/11/web-1-1.jsonl.gz", "other app")
+
+	from := time.Date(2020, time.October, 11, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2020, time.October, 12, 0, 0, 0, 0, time.UTC)
+
+	archives, err := u.List("app", from, to)
+	require.NoError(t, err)
+
+	var keys []string
+	for _, a := range archives {
+		keys = append(keys, a.Key)
+	}
+
+	assert.Equal(t, []string{
+		"my-app/app/2020/10/11/web-1-1.jsonl.gz",
+		"my-app/app/2020/10/11/web-1-2.jsonl.gz",
+		"my-app/app/2020/10/12/web-1-1.jsonl.gz",
+	}, keys)
+
+	assert.Equal(t, from, archives[0].Date)
+	assert.Equal(t, to, archives[2].Date)
+
+	dst, err := ioutil.TempDir("", "juggler-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dst)
+
+	files, err := u.Restore("app", from, from, dst, true)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		filepath.Join(dst, "app", "2020", "10", "11", "web-1-1.jsonl"),
+		filepath.Join(dst, "app", "2020", "10", "11", "web-1-2.jsonl"),
+	}, files)
+
+	b, err := ioutil.ReadFile(files[1])
+	require.NoError(t, err)
+	assert.Equal(t, "11th, second", string(b))
+}
+
+func TestListSubDaily(t *testing.T) {
+	src, err := ioutil.TempDir("", "juggler-archives")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+
+	_, srv := newFakeS3()
+	defer srv.Close()
+
+	u, err := New(Config{
+		Bucket:   "logs",
+		Region:   "us-east-1",
+		Id:       "id",
+		Secret:   "secret",
+		Endpoint: srv.URL,
+		NoSSL:    true,
+	})
+
+	require.NoError(t, err)
+
+	for _, name := range []string{
+		"app-2020-10-10T23.1.log.gz",
+		"app-2020-10-11T00.1.log.gz",
+		"app-2020-10-11T05.1.log.gz",
+		"app-2020-10-11T23-45.1.log.gz",
+		"app-2020-10-12T00.1.log.gz",
+	} {
+		fp := filepath.Join(src, name)
+		require.NoError(t, ioutil.WriteFile(fp, gzipped(t, name), 0600))
+		require.NoError(t, u.Upload(fp))
+	}
+
+	// the whole day, whatever time of the day from and to are
+	day := time.Date(2020, time.October, 11, 12, 0, 0, 0, time.UTC)
+
+	archives, err := u.List("app", day, day)
+	require.NoError(t, err)
+
+	var keys []string
+	for _, a := range archives {
+		keys = append(keys, a.Key)
+	}
+
+	assert.Equal(t, []string{
+		"app-2020-10-11T00.1.log.gz",
+		"app-2020-10-11T05.1.log.gz",
+		"app-2020-10-11T23-45.1.log.gz",
+	}, keys)
+
+	assert.Equal(t, time.Date(2020, time.October, 11, 23, 45, 0, 0, time.UTC), archives[2].Date)
+}
+
+func gzipped(t *testing.T, content string) []byte {
+	var b bytes.Buffer
+
+	gz := gzip.NewWriter(&b)
+	_, err := gz.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	return b.Bytes()
+}
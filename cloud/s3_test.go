@@ -0,0 +1,150 @@
+package cloud
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type fakeObject struct {
+	body     []byte
+	metadata http.Header
+}
+
+// fakeS3 keeps objects put into it in memory and answers HEAD requests,
+// puts counts the objects put by key, reads are forbidden if writeOnly is set
+type fakeS3 struct {
+	mu        sync.Mutex
+	objects   map[string]fakeObject
+	puts      map[string]int
+	writeOnly bool
+}
+
+func newFakeS3() (*fakeS3, *httptest.Server) {
+	s := &fakeS3{objects: make(map[string]fakeObject), puts: make(map[string]int)}
+	return s, httptest.NewServer(s)
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		metadata := make(http.Header)
+		for k, v := range r.Header {
+			if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") || k == "Content-Encoding" {
+				metadata[k] = v
+			}
+		}
+
+		s.objects[key] = fakeObject{body: body, metadata: metadata}
+		s.puts[key]++
+
+		w.Header().Set("ETag", etagOf(body))
+	case http.MethodGet, http.MethodHead:
+		if s.writeOnly {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if r.URL.Query().Get("list-type") == "2" {
+			s.list(w, key, r.URL.Query().Get("prefix"))
+			return
+		}
+
+		o, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		for k, v := range o.metadata {
+			w.Header()[k] = v
+		}
+
+		w.Header().Set("ETag", etagOf(o.body))
+
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(o.body)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, bucket, prefix string) {
+	type content struct {
+		Key          string
+		LastModified time.Time
+		Size         int
+	}
+
+	result := struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Contents []content
+	}{}
+
+	for key, o := range s.objects {
+		key = strings.TrimPrefix(key, bucket+"/")
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{Key: key, LastModified: time.Now(), Size: len(o.body)})
+		}
+	}
+
+	sort.Slice(result.Contents, func(i, j int) bool {
+		return result.Contents[i].Key < result.Contents[j].Key
+	})
+
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func (s *fakeS3) put(key string, body []byte, metadata http.Header) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.objects[key] = fakeObject{body: body, metadata: metadata}
+}
+
+func (s *fakeS3) forbidReads() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writeOnly = true
+}
+
+func (s *fakeS3) object(key string) (fakeObject, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.objects[key]
+
+	return o, ok
+}
+
+func (s *fakeS3) putCount(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.puts[key]
+}
+
+func etagOf(body []byte) string {
+	sum := md5.Sum(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
@@ -0,0 +1,135 @@
+package cloud
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIdempotentUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "juggler-upload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	content := []byte("compressed fake - log - content")
+	fp := filepath.Join(dir, "app-2020-10-11.1.log.gz")
+	require.NoError(t, ioutil.WriteFile(fp, content, 0600))
+
+	sum := sha256.Sum256(content)
+	hashed := "app-2020-10-11.1." + hex.EncodeToString(sum[:])[:12] + ".log.gz"
+
+	connectWith := func(t *testing.T, cfg Config) (*fakeS3, *S3GzipCloud) {
+		s, srv := newFakeS3()
+		t.Cleanup(srv.Close)
+
+		cfg.Bucket = "logs"
+		cfg.Region = "us-east-1"
+		cfg.Id = "id"
+		cfg.Secret = "secret"
+		cfg.Endpoint = srv.URL
+		cfg.NoSSL = true
+
+		u, err := New(cfg)
+		require.NoError(t, err)
+
+		return s, u
+	}
+
+	connect := func(t *testing.T) (*fakeS3, *S3GzipCloud) {
+		return connectWith(t, Config{})
+	}
+
+	t.Run("new objects are uploaded once", func(t *testing.T) {
+		s, u := connect(t)
+
+		require.NoError(t, u.Upload(fp))
+		require.NoError(t, u.Upload(fp))
+
+		o, ok := s.object("logs/app-2020-10-11.1.log.gz")
+		require.True(t, ok)
+		assert.Equal(t, content, o.body)
+		assert.Equal(t, 1, s.putCount("logs/app-2020-10-11.1.log.gz"))
+	})
+
+	t.Run("different objects are not overwritten", func(t *testing.T) {
+		s, u := connect(t)
+		s.put("logs/app-2020-10-11.1.log.gz", []byte("someone else's content"), http.Header{})
+
+		require.NoError(t, u.Upload(fp))
+		require.NoError(t, u.Upload(fp))
+
+		o, _ := s.object("logs/app-2020-10-11.1.log.gz")
+		assert.Equal(t, []byte("someone else's content"), o.body)
+
+		o, ok := s.object("logs/" + hashed)
+		require.True(t, ok)
+		assert.Equal(t, content, o.body)
+		assert.Equal(t, 1, s.putCount("logs/"+hashed))
+	})
+
+	t.Run("objects uploaded before checksums were kept are compared by etag", func(t *testing.T) {
+		s, u := connect(t)
+		s.put("logs/app-2020-10-11.1.log.gz", content, http.Header{})
+
+		require.NoError(t, u.Upload(fp))
+
+		assert.Equal(t, 0, s.putCount("logs/app-2020-10-11.1.log.gz"))
+		assert.Equal(t, 0, s.putCount("logs/"+hashed))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		_, u := connect(t)
+
+		err := u.Upload(filepath.Join(dir, "missing.log.gz"))
+
+		var e *Error
+		if assert.True(t, errors.As(err, &e)) {
+			assert.Equal(t, OpUpload, e.Op)
+			assert.Equal(t, filepath.Join(dir, "missing.log.gz"), e.Path)
+		}
+
+		assert.True(t, os.IsNotExist(errors.Cause(err)))
+	})
+	t.Run("cancelled uploads", func(t *testing.T) {
+		s, u := connect(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := u.UploadWithContext(ctx, fp)
+
+		var e *Error
+		if assert.True(t, errors.As(err, &e)) {
+			assert.Equal(t, OpUpload, e.Op)
+		}
+
+		assert.Contains(t, err.Error(), "canceled")
+		assert.Equal(t, 0, s.putCount("logs/app-2020-10-11.1.log.gz"))
+	})
+	t.Run("write only credentials", func(t *testing.T) {
+		s, u := connect(t)
+		s.forbidReads()
+
+		err := u.Upload(fp)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "unless WriteOnly is set")
+		assert.Equal(t, 0, s.putCount("logs/app-2020-10-11.1.log.gz"))
+
+		s, u = connectWith(t, Config{WriteOnly: true})
+		s.forbidReads()
+
+		require.NoError(t, u.Upload(fp))
+
+		o, ok := s.object("logs/app-2020-10-11.1.log.gz")
+		require.True(t, ok)
+		assert.Equal(t, content, o.body)
+	})
+}
@@ -0,0 +1,172 @@
+package codec
+
+import (
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Codec compresses rotated log files
+type Codec interface {
+	// Extension is appended to the name of a compressed file, e.g. ".gz"
+	Extension() string
+	// Encoding is the content encoding of a compressed file, e.g. "gzip"
+	Encoding() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// Decompressor is implemented by codecs which can read back what they compressed,
+// all the builtin codecs do
+type Decompressor interface {
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var builtin = []Codec{Gzip(gzip.DefaultCompression), Zstd(3), LZ4(0)}
+
+// Extensions returns the extensions of all the builtin codecs
+func Extensions() []string {
+	result := make([]string, len(builtin))
+	for i, c := range builtin {
+		result[i] = c.Extension()
+	}
+
+	return result
+}
+
+// ByExtension finds a builtin codec the file name was compressed with
+func ByExtension(name string) (Codec, bool) {
+	for _, c := range builtin {
+		if strings.HasSuffix(name, c.Extension()) {
+			return c, true
+		}
+	}
+
+	return nil, false
+}
+
+type gzipCodec struct {
+	level int
+}
+
+// Gzip compresses with the given level from gzip.HuffmanOnly to gzip.BestCompression,
+// gzip.DefaultCompression is used for levels out of that range
+func Gzip(level int) Codec {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		level = gzip.DefaultCompression
+	}
+
+	return gzipCodec{level: level}
+}
+
+func (gzipCodec) Extension() string {
+	return ".gz"
+}
+
+func (gzipCodec) Encoding() string {
+	return "gzip"
+}
+
+func (c gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	gz, err := gzip.NewWriterLevel(w, c.level)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create gzip writer with level %d", c.level)
+	}
+
+	return gz, nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create gzip reader")
+	}
+
+	return gz, nil
+}
+
+type zstdCodec struct {
+	level int
+}
+
+// Zstd compresses with the given zstd level, levels are mapped to the ones supported
+// by the encoder: 1 is the fastest, 3 is the default, 11 and above the best compression
+func Zstd(level int) Codec {
+	return zstdCodec{level: level}
+}
+
+func (zstdCodec) Extension() string {
+	return ".zst"
+}
+
+func (zstdCodec) Encoding() string {
+	return "zstd"
+}
+
+func (c zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	zw, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create zstd writer with level %d", c.level)
+	}
+
+	return zw, nil
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create zstd reader")
+	}
+
+	return zr.IOReadCloser(), nil
+}
+
+var lz4Levels = []lz4.CompressionLevel{
+	lz4.Fast,
+	lz4.Level1,
+	lz4.Level2,
+	lz4.Level3,
+	lz4.Level4,
+	lz4.Level5,
+	lz4.Level6,
+	lz4.Level7,
+	lz4.Level8,
+	lz4.Level9,
+}
+
+type lz4Codec struct {
+	level lz4.CompressionLevel
+}
+
+// LZ4 compresses with the given level from 0, the fastest, to 9, the best compression
+func LZ4(level int) Codec {
+	if level < 0 || level >= len(lz4Levels) {
+		level = 0
+	}
+
+	return lz4Codec{level: lz4Levels[level]}
+}
+
+func (lz4Codec) Extension() string {
+	return ".lz4"
+}
+
+func (lz4Codec) Encoding() string {
+	return "lz4"
+}
+
+func (c lz4Codec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	zw := lz4.NewWriter(w)
+	if err := zw.Apply(lz4.CompressionLevelOption(c.level)); err != nil {
+		return nil, errors.Wrapf(err, "could not create lz4 writer with level %d", c.level)
+	}
+
+	return zw, nil
+}
+
+func (lz4Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(lz4.NewReader(r)), nil
+}
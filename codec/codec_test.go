@@ -0,0 +1,103 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	content := bytes.Repeat([]byte("fake - log - content\n"), 100)
+
+	tt := []struct {
+		codec     Codec
+		extension string
+		encoding  string
+		reader    func(r io.Reader) (io.Reader, error)
+	}{
+		{
+			codec:     Gzip(gzip.BestCompression),
+			extension: ".gz",
+			encoding:  "gzip",
+			reader: func(r io.Reader) (io.Reader, error) {
+				return gzip.NewReader(r)
+			},
+		},
+		{
+			codec:     Zstd(11),
+			extension: ".zst",
+			encoding:  "zstd",
+			reader: func(r io.Reader) (io.Reader, error) {
+				return zstd.NewReader(r)
+			},
+		},
+		{
+			codec:     LZ4(9),
+			extension: ".lz4",
+			encoding:  "lz4",
+			reader: func(r io.Reader) (io.Reader, error) {
+				return lz4.NewReader(r), nil
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.encoding, func(t *testing.T) {
+			assert.Equal(t, tc.extension, tc.codec.Extension())
+			assert.Equal(t, tc.encoding, tc.codec.Encoding())
+
+			var compressed bytes.Buffer
+
+			w, err := tc.codec.NewWriter(&compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := w.Write(content); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			assert.True(t, compressed.Len() < len(content))
+
+			compressedContent := compressed.Bytes()
+
+			r, err := tc.reader(bytes.NewReader(compressedContent))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, content, b)
+
+			d, ok := tc.codec.(Decompressor)
+			if assert.True(t, ok) {
+				rc, err := d.NewReader(bytes.NewReader(compressedContent))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				b, err := ioutil.ReadAll(rc)
+				assert.NoError(t, err)
+				assert.NoError(t, rc.Close())
+				assert.Equal(t, content, b)
+			}
+
+			c, ok := ByExtension("test_log-2018-01-30.1.log" + tc.extension)
+			assert.True(t, ok)
+			assert.Equal(t, tc.encoding, c.Encoding())
+		})
+	}
+
+	_, ok := ByExtension("test_log-2018-01-30.1.log")
+	assert.False(t, ok)
+}
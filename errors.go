@@ -0,0 +1,120 @@
+package juggler
+
+import (
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// Op names the operation which failed
+type Op string
+
+const (
+	// OpWrite is writing to the current file
+	OpWrite Op = "write"
+	// OpRotate is switching to another file
+	OpRotate Op = "rotate"
+	// OpScan is reading the log directory
+	OpScan Op = "scan"
+	// OpCompress is compressing a rotated file
+	OpCompress Op = "compress"
+	// OpHook is running a custom post rotation hook
+	OpHook Op = "hook"
+	// OpUpload is uploading a rotated file or keeping track of files to upload
+	OpUpload Op = "upload"
+	// OpPrune is removing files which are not retained anymore
+	OpPrune Op = "prune"
+	// OpShutdown is waiting for the background work on shutdown
+	OpShutdown Op = "shutdown"
+)
+
+var (
+	// ErrClosed is returned by writes to a Juggler which is closed or shut down
+	ErrClosed = errors.New("juggler is closed")
+	// ErrQueueFull is reported when writes are dropped since the write queue is full
+	ErrQueueFull = errors.New("write queue is full")
+)
+
+// Error is returned and reported by Juggler, errors.As finds it in the errors
+// sent to observers, the cause is found by errors.Is and errors.As as well
+type Error struct {
+	Op   Op
+	Path string
+	Err  error
+
+	// Retryable tells that Juggler tries the operation again by itself
+	Retryable bool
+}
+
+func (e *Error) Error() string {
+	return string(e.Op) + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Cause makes errors.Cause of github.com/pkg/errors find the cause
+func (e *Error) Cause() error {
+	return e.Err
+}
+
+// opError wraps err as an error of the operation, errors of other
+// operations it was caused by are kept as they are
+func opError(op Op, path string, err error, retryable bool) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+
+	return &Error{Op: op, Path: path, Err: err, Retryable: retryable}
+}
+
+// Errors are returned by Shutdown when more than one thing went wrong,
+// errors.Is and errors.As look into every one of them
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// Is tells whether any of the errors is target
+func (e Errors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// As finds the first of the errors which target can be set to
+func (e Errors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// errorOf returns nil, the only error or all of them
+func errorOf(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return Errors(errs)
+	}
+}
@@ -0,0 +1,85 @@
+package juggler
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestErrors(t *testing.T) {
+	prefix := "test_log"
+
+	t.Run("write", func(t *testing.T) {
+		dir := makeTestDir(randomString(14), t)
+		defer os.RemoveAll(dir)
+
+		j := New(prefix, dir, WithMaxMegabytes(1))
+		defer j.Close()
+
+		_, err := j.Write(make([]byte, megabyte+1))
+
+		var e *Error
+		if assert.True(t, errors.As(err, &e)) {
+			assert.Equal(t, OpWrite, e.Op)
+			assert.False(t, e.Retryable)
+		}
+	})
+
+	t.Run("write after close", func(t *testing.T) {
+		dir := makeTestDir(randomString(14), t)
+		defer os.RemoveAll(dir)
+
+		j := New(prefix, dir, WithBufferedWrites(1024, time.Second))
+		assert.NoError(t, j.Close())
+
+		_, err := j.Write([]byte("entry"))
+		assert.True(t, errors.Is(err, ErrClosed))
+	})
+
+	t.Run("upload", func(t *testing.T) {
+		uf := uncompressedIdenticalTestFileFactory(prefix, "uncompressed fake - log - content")
+		cleanUp, dir, err := createFakeLogFiles(randomString(14), uf("2018-01-28", 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer cleanUp()
+
+		s3Down := errors.New("s3 is down")
+		u := &fakeUploader{}
+		u.fail(s3Down)
+
+		errCh := make(chan error, 10)
+		j := New(prefix, dir, WithCloudUploader(u), withNowFunc(createNowFunc(dateSuffix, "2018-01-30")))
+		j.NotifyOnError(errCh)
+		defer j.Close()
+
+		select {
+		case err := <-errCh:
+			var e *Error
+			if assert.True(t, errors.As(err, &e)) {
+				assert.Equal(t, OpUpload, e.Op)
+				assert.Equal(t, filepath.Join(dir, "test_log-2018-01-28.1.log"), e.Path)
+				assert.True(t, e.Retryable)
+			}
+
+			assert.True(t, errors.Is(err, s3Down))
+		case <-time.After(time.Second):
+			t.Fatal("upload error was not reported")
+		}
+	})
+
+	t.Run("aggregated", func(t *testing.T) {
+		assert.Nil(t, errorOf(nil))
+
+		first := errors.New("first")
+		assert.Equal(t, first, errorOf([]error{first}))
+
+		err := errorOf([]error{first, errors.New("second")})
+		assert.EqualError(t, err, "first; second")
+		assert.Len(t, err.(Errors), 2)
+	})
+}
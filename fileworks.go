@@ -1,40 +1,46 @@
 package juggler
 
 import (
-	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
+	"github.com/denismitr/juggler/codec"
 	"github.com/pkg/errors"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"regexp"
 	"sort"
-	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
 type logFileMeta struct {
-	daysAgo int
+	periodsAgo int
 	version int
-	dir string
+	date time.Time
+	end time.Time
+	compressed bool
+	path string
 	f os.FileInfo
 }
 
 func (f logFileMeta) fullPath() string {
-	return filepath.Join(f.dir, f.f.Name())
+	return f.path
+}
+
+func (f logFileMeta) rotated() RotatedFile {
+	return RotatedFile{Path: f.path, Date: f.date, Version: f.version, Size: f.f.Size()}
 }
 
 type orderedLogFilesMeta []logFileMeta
 
 func (f orderedLogFilesMeta) Less(i, j int) bool {
-	if f[i].daysAgo > f[j].daysAgo {
+	if f[i].periodsAgo > f[j].periodsAgo {
 		return true
 	}
 
-	if f[i].daysAgo == f[j].daysAgo {
+	if f[i].periodsAgo == f[j].periodsAgo {
 		return f[i].version < f[j].version
 	}
 
@@ -49,166 +55,259 @@ func (f orderedLogFilesMeta) Len() int {
 	return len(f)
 }
 
-func gzippedName(file string) string {
-	return file + ".gz"
+func compressedName(file string, c codec.Codec) string {
+	return file + c.Extension()
 }
 
-func parseLogFileMeta(dir string, f os.FileInfo, prefix string, format *regexp.Regexp, nowFunc nowFunc, tz *time.Location) (logFileMeta, bool) {
-	if ! strings.HasSuffix(f.Name(), ".log") {
-		return logFileMeta{}, false
+func parseLogFileMeta(path, name string, f os.FileInfo, naming *filenameTemplate, nowFunc nowFunc) (logFileMeta, bool) {
+	compressed := false
+	for _, ext := range naming.extensions {
+		if strings.HasSuffix(name, ext) {
+			name = strings.TrimSuffix(name, ext)
+			compressed = true
+			break
+		}
 	}
 
-	if ! strings.HasPrefix(f.Name(), prefix) {
+	t, version, ok := naming.parse(name)
+	if !ok {
 		return logFileMeta{}, false
 	}
 
-	matches := format.FindStringSubmatch(f.Name())
-	result := logFileMeta{f: f, dir: dir}
+	return logFileMeta{
+		periodsAgo: naming.period.between(t, nowFunc(), naming.tz),
+		version: version,
+		date: t,
+		end: naming.period.end(t, naming.tz),
+		compressed: compressed,
+		path: path,
+		f: f,
+	}, true
+}
 
-	if len(matches) == 0 {
-		return logFileMeta{}, false
+// scanBackups finds log files which are not compressed yet
+func scanBackups(dir string, naming *filenameTemplate, nowFunc nowFunc) ([]logFileMeta, error) {
+	files, err := scanLogFiles(dir, naming, nowFunc)
+	if err != nil {
+		return nil, err
 	}
 
-	now := nowFunc()
-
-	for i, name := range format.SubexpNames() {
-		if i != 0 && name == "version" && matches[i] != "" {
-			v, _ := strconv.Atoi(matches[i])
-			if v != 0 {
-				result.version = v
-			}
-		}
-
-		if i != 0 && name == "date" && matches[i] != "" {
-			days, err := parseDayDiff(matches[i], now, tz)
-			if err != nil {
-				panic(err) // todo: remove
-			}
-			result.daysAgo = days
+	var result []logFileMeta
+	for _, f := range files {
+		if !f.compressed {
+			result = append(result, f)
 		}
 	}
 
-	return result, true
+	return result, nil
 }
 
-func parseDayDiff(date string, now time.Time, tz *time.Location) (days int, err error) {
-	t, err := time.Parse(dateSuffix, date)
-	if err != nil {
-		err = errors.Wrapf(err, "could not parse date %s", date)
-		return
+// scanLogFiles finds all log files, compressed ones included, ordered from the oldest to the newest
+func scanLogFiles(dir string, naming *filenameTemplate, nowFunc nowFunc) ([]logFileMeta, error) {
+	if dir == "" {
+		return nil, opError(OpScan, dir, errors.Errorf("Directory is not set"), false)
 	}
 
-	now = now.In(tz)
-	days = int(now.Sub(t).Hours() / 24)
+	var result []logFileMeta
 
-	return
-}
+	if naming.nested {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
 
-func scanBackups(
-	dir, prefix string,
-	format *regexp.Regexp,
-	nowFunc nowFunc,
-	tz *time.Location,
-) ([]logFileMeta, error) {
-	if dir == "" {
-		return nil, errors.Errorf("Directory is not set")
-	}
+			if info.IsDir() {
+				return nil
+			}
 
-	files, err := ioutil.ReadDir(dir)
-	if err != nil {
-		return nil, errors.Wrapf(err, "could not read directory [%s] content", dir)
-	}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
 
-	var result []logFileMeta
+			if logFile, ok := parseLogFileMeta(path, filepath.ToSlash(rel), info, naming, nowFunc); ok {
+				result = append(result, logFile)
+			}
 
-	for i := range files {
-		if files[i].IsDir() {
-			continue
+			return nil
+		})
+
+		if err != nil {
+			return nil, opError(OpScan, dir, errors.Wrapf(err, "could not walk directory [%s]", dir), true)
+		}
+	} else {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, opError(OpScan, dir, errors.Wrapf(err, "could not read directory [%s] content", dir), true)
 		}
 
-		if logFile, ok := parseLogFileMeta(dir, files[i], prefix, format, nowFunc, tz); ok {
-			result = append(result, logFile)
+		for i := range files {
+			if files[i].IsDir() {
+				continue
+			}
+
+			path := filepath.Join(dir, files[i].Name())
+			if logFile, ok := parseLogFileMeta(path, files[i].Name(), files[i], naming, nowFunc); ok {
+				result = append(result, logFile)
+			}
 		}
 	}
 
 	sort.Sort(orderedLogFilesMeta(result))
 
-	// if last entry is today exclude it from storage list
-	if len(result) > 0 && result[len(result) - 1].daysAgo == 0 {
-		result = result[:len(result) - 1]
-	}
-
 	return result, nil
 }
 
-func compressAndRemove(src string, wg *sync.WaitGroup, errCh chan<- error, nextCh chan string) {
-	defer wg.Done()
+// digest holds checksums of a file
+type digest struct {
+	md5    []byte
+	sha256 []byte
+}
+
+// compressAndRemove compresses src next to it and removes src once the compressed file is complete,
+// checksums of the compressed file are computed on the way
+func compressAndRemove(src string, c codec.Codec) (string, digest, error) {
 	f, err := os.Open(src)
 	if err != nil {
-		errCh <- errors.Wrapf(err, "failed to open log file: %s", src)
-		return
+		return "", digest{}, errors.Wrapf(err, "failed to open log file: %s", src)
 	}
 
-	defer func() {
-		if err := f.Close(); err != nil {
-			errCh <- err
-		}
-	}()
+	defer f.Close()
 
 	fi, err := osStat(src)
 	if err != nil {
-		errCh <- errors.Wrapf(err, "failed to read stats from file %s", src)
-		return
+		return "", digest{}, errors.Wrapf(err, "failed to read stats from file %s", src)
 	}
 
-	dst := gzippedName(src)
+	dst := compressedName(src, c)
 
 	gzf, err := os.OpenFile(dst, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, fi.Mode())
 	if err != nil {
-		errCh <- errors.Wrapf(err, "failed to create file %s", dst)
-		return
+		return "", digest{}, errors.Wrapf(err, "failed to create file %s", dst)
 	}
 
-	defer func() {
-		if err := os.Remove(src); err != nil {
-			errCh <- err
-		}
-
-		if err := gzf.Close(); err != nil {
-			errCh <- err
-		}
-	}()
+	discard := func(err error) (string, digest, error) {
+		_ = gzf.Close()
+		_ = os.Remove(dst)
+		return "", digest{}, err
+	}
 
 	if err := chown(dst, fi); err != nil {
-		errCh <- fmt.Errorf("failed to chown compressed log file: %v", err)
-		return
+		return discard(fmt.Errorf("failed to chown compressed log file: %v", err))
 	}
 
-	gz := gzip.NewWriter(gzf)
+	md5sum, sha256sum := md5.New(), sha256.New()
+
+	gz, err := c.NewWriter(io.MultiWriter(gzf, md5sum, sha256sum))
+	if err != nil {
+		return discard(err)
+	}
 
 	if _, err := io.Copy(gz, f); err != nil {
-		errCh <- errors.Wrapf(err, "could not copy compressed content from %s to %s", src, dst)
-		return
+		return discard(errors.Wrapf(err, "could not copy compressed content from %s to %s", src, dst))
 	}
 
 	if err := gz.Close(); err != nil {
-		errCh <- err
-		return
+		return discard(errors.Wrapf(err, "could not finish compression of %s", dst))
 	}
 
-	if nextCh != nil {
-		nextCh <- dst
+	if err := gzf.Close(); err != nil {
+		_ = os.Remove(dst)
+		return "", digest{}, errors.Wrapf(err, "could not close compressed file %s", dst)
 	}
+
+	d := digest{md5: md5sum.Sum(nil), sha256: sha256sum.Sum(nil)}
+
+	if err := os.Remove(src); err != nil {
+		return dst, d, errors.Wrapf(err, "could not remove %s after compression", src)
+	}
+
+	return dst, d, nil
 }
 
-func resolveFilepath(prefix, dir string, currentTime time.Time, currentVersion int, tz *time.Location) string {
-	if tz != nil {
-		currentTime = currentTime.In(tz)
-	} else {
-		currentTime = currentTime.UTC()
+// latestVersion returns the version to continue writing with in the current period
+func latestVersion(dir string, naming *filenameTemplate, nowFunc nowFunc) int {
+	version := 1
+
+	// rotated files might have been uploaded, moved or pruned since
+	if b, err := ioutil.ReadFile(rotatedMark(dir, naming.prefix)); err == nil {
+		rel := strings.TrimSpace(string(b))
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+
+		if f, ok := parseLogFileMeta(path, rel, nil, naming, nowFunc); ok && f.periodsAgo == 0 {
+			version = f.version + 1
+		}
+	}
+
+	files, err := scanLogFiles(dir, naming, nowFunc)
+	if err != nil {
+		return version
+	}
+
+	for _, f := range files {
+		if f.periodsAgo != 0 {
+			continue
+		}
+
+		// a compressed file is done with, so writing continues with the next version
+		v := f.version
+		if f.compressed {
+			v++
+		}
+
+		if v > version {
+			version = v
+		}
+	}
+
+	return version
+}
+
+// rotatedMark is the file remembering the last rotated file, so that
+// versions are not used again after restarts
+func rotatedMark(dir, prefix string) string {
+	return filepath.Join(dir, "."+prefix+".rotated")
+}
+
+// markRotated remembers path as the last rotated file
+func markRotated(mark, dir, path string) error {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return errors.Wrapf(err, "file %s is outside of %s", path, dir)
+	}
+
+	tmp := mark + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(filepath.ToSlash(rel)+"\n"), 0644); err != nil {
+		return errors.Wrapf(err, "could not write %s", tmp)
+	}
+
+	return errors.Wrapf(os.Rename(tmp, mark), "could not replace %s", mark)
+}
+
+// replaceSymlink atomically points link to target by renaming a temporary symlink over it
+func replaceSymlink(link, target string) error {
+	rel, err := filepath.Rel(filepath.Dir(link), target)
+	if err != nil {
+		rel = target
+	}
+
+	tmp := link + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "could not remove stale symlink %s", tmp)
 	}
 
-	date := currentTime.Format(dateSuffix)
+	if err := os.Symlink(rel, tmp); err != nil {
+		return errors.Wrapf(err, "could not create symlink %s", tmp)
+	}
+
+	if err := os.Rename(tmp, link); err != nil {
+		_ = os.Remove(tmp)
+		return errors.Wrapf(err, "could not replace symlink %s", link)
+	}
+
+	return nil
+}
 
-	return filepath.Join(dir, fmt.Sprintf("%s-%s.%d%s", prefix, date, currentVersion, defaultExt))
+func resolveFilepath(dir string, naming *filenameTemplate, currentTime time.Time, currentVersion int) string {
+	return filepath.Join(dir, filepath.FromSlash(naming.filename(currentTime, currentVersion)))
 }
@@ -3,14 +3,15 @@ package juggler
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
+	"github.com/denismitr/juggler/codec"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
-	"sync"
 	"testing"
 	"time"
 )
@@ -21,7 +22,7 @@ func TestParseLogFileMeta(t *testing.T) {
 		dirName      string
 		ago          time.Duration
 		prefix       string
-		daysAgo      int
+		periodsAgo   int
 		version      int
 		existingFile func(dir, prefix string, now time.Time, version int) string
 		err          error
@@ -34,7 +35,7 @@ func TestParseLogFileMeta(t *testing.T) {
 				return filepath.Join(dir, fmt.Sprintf("test_log-%s.1.log", now.Format(dateSuffix)))
 			},
 			version: 1,
-			daysAgo: 2,
+			periodsAgo: 2,
 			prefix:  "test_log",
 			err:     nil,
 		},
@@ -46,7 +47,7 @@ func TestParseLogFileMeta(t *testing.T) {
 				return filepath.Join(dir, fmt.Sprintf("test_log-%s.%d.log", now.Format(dateSuffix), version))
 			},
 			version: 3,
-			daysAgo: 1,
+			periodsAgo: 1,
 			prefix:  "test_log",
 			err:     nil,
 		},
@@ -76,22 +77,23 @@ func TestParseLogFileMeta(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			lf, ok := parseLogFileMeta(dir, fi, tc.prefix, createFormat(tc.prefix), nowFunc, time.UTC)
+			lf, ok := parseLogFileMeta(existingFile, fi.Name(), fi, testNaming(tc.prefix), nowFunc)
 
 			assert.True(t, ok, "regex could not match filename")
 			assert.Equal(t, tc.version, lf.version)
-			assert.Equal(t, tc.daysAgo, lf.daysAgo)
+			assert.Equal(t, tc.periodsAgo, lf.periodsAgo)
 		})
 	}
 }
 
-func TestParseDiffInDays(t *testing.T) {
+func TestPeriodBetween(t *testing.T) {
 	tt := []struct {
-		in    string
-		today string
-		tz    *time.Location
-		diff  int
-		err   error
+		in       string
+		today    string
+		interval time.Duration
+		tz       *time.Location
+		diff     int
+		err      error
 	}{
 		{
 			in:    "2001-10-11",
@@ -114,17 +116,59 @@ func TestParseDiffInDays(t *testing.T) {
 			diff:  3,
 			err:   nil,
 		},
+		{
+			in:       "2001-10-11T22",
+			today:    "2001-10-12T01-04-05.000",
+			interval: Hourly,
+			tz:       location("UTC"),
+			diff:     3,
+			err:      nil,
+		},
+		{
+			in:       "2001-10-11T23-45",
+			today:    "2001-10-12T00-29-59.000",
+			interval: 15 * time.Minute,
+			tz:       location("UTC"),
+			diff:     2,
+			err:      nil,
+		},
+		{
+			in:       "2001-10-11T21",
+			today:    "2001-10-12T00-30-00.000",
+			interval: 7 * time.Hour,
+			tz:       location("UTC"),
+			diff:     1,
+			err:      nil,
+		},
+		{
+			in:       "2001-10-11T14",
+			today:    "2001-10-13T07-00-00.000",
+			interval: 7 * time.Hour,
+			tz:       location("UTC"),
+			diff:     7,
+			err:      nil,
+		},
+		{
+			in:       "2001-10-01",
+			today:    "2001-10-14T23-59-59.000",
+			interval: Weekly,
+			tz:       location("UTC"),
+			diff:     1,
+			err:      nil,
+		},
 	}
 
 	for _, tc := range tt {
 		t.Run(tc.in, func(t *testing.T) {
 			nowFunc := createNowFunc(testTimeFormat, tc.today)
-			days, err := parseDayDiff(tc.in, nowFunc(), tc.tz)
+			p := newPeriod(tc.interval)
+			from, err := time.ParseInLocation(p.layout, tc.in, tc.tz)
 			if tc.err == nil {
 				assert.NoError(t, err)
 			}
 
-			assert.Equal(t, tc.diff, days)
+			periods := p.between(from, nowFunc(), tc.tz)
+			assert.Equal(t, tc.diff, periods)
 		})
 	}
 }
@@ -150,14 +194,14 @@ func TestScanBackups(t *testing.T) {
 
 		nowFunc := createNowFunc(dateSuffix, "2018-01-30")
 
-		lfs, err := scanBackups(dir, prefix, createFormat(prefix), nowFunc, time.UTC)
+		lfs, err := scanBackups(dir, testNaming(prefix), nowFunc)
 
 		assert.NoError(t, err)
 		assert.Equal(t, 4, len(lfs), "expected exactly 4 backups found")
-		assert.Equal(t, 8, lfs[0].daysAgo)
-		assert.Equal(t, 7, lfs[1].daysAgo)
-		assert.Equal(t, 5, lfs[2].daysAgo)
-		assert.Equal(t, 1, lfs[3].daysAgo)
+		assert.Equal(t, 8, lfs[0].periodsAgo)
+		assert.Equal(t, 7, lfs[1].periodsAgo)
+		assert.Equal(t, 5, lfs[2].periodsAgo)
+		assert.Equal(t, 1, lfs[3].periodsAgo)
 
 		for _, lf := range lfs {
 			assert.Equal(t, 0, lf.version)
@@ -187,13 +231,13 @@ func TestScanBackups(t *testing.T) {
 		defer cleanUp()
 
 		nowFunc := createNowFunc(dateSuffix, "2018-01-30")
-		lfs, err := scanBackups(dir, prefix, createFormat(prefix), nowFunc, time.UTC)
+		lfs, err := scanBackups(dir, testNaming(prefix), nowFunc)
 
 		assert.NoError(t, err)
 		assert.Equal(t, 3, len(lfs), "expected exactly 4 backups found")
-		assert.Equal(t, 7, lfs[0].daysAgo)
-		assert.Equal(t, 5, lfs[1].daysAgo)
-		assert.Equal(t, 1, lfs[2].daysAgo)
+		assert.Equal(t, 7, lfs[0].periodsAgo)
+		assert.Equal(t, 5, lfs[1].periodsAgo)
+		assert.Equal(t, 1, lfs[2].periodsAgo)
 
 		for _, lf := range lfs {
 			assert.Equal(t, 0, lf.version)
@@ -223,26 +267,22 @@ func TestCompression(t *testing.T) {
 		assert.NoError(t, err)
 		assert.True(t, ok)
 
-		var wg sync.WaitGroup
-		errCh := make(chan error, 10)
-		dstCh := make(chan string)
+		dst, d, err := compressAndRemove(file, codec.Gzip(gzip.DefaultCompression))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, gzippedName(file), dst)
 
-		wg.Add(2)
-		go compressAndRemove(file, &wg, errCh, dstCh)
-		go func() {
-			defer wg.Done()
-			select {
-			case err := <-errCh:
-				t.Fatal(err)
-				break
-			case dst := <-dstCh:
-				log.Println(dst)
-				assert.Equal(t, dst, gzippedName(file))
-				break
-			}
-		}()
+		compressed, err := ioutil.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-		wg.Wait()
+		md5sum := md5.Sum(compressed)
+		sha256sum := sha256.Sum256(compressed)
+		assert.Equal(t, md5sum[:], d.md5)
+		assert.Equal(t, sha256sum[:], d.sha256)
 
 		f, err := os.Open(file + ".gz")
 		if err != nil {
@@ -276,6 +316,7 @@ func TestResolveFilepath(t *testing.T) {
 	    currentTime time.Time
 	    tz *time.Location
 	    currentVersion int
+	    interval time.Duration
 	}{
 	    {
 	        expected: "/tmp/logs/test_log-2018-01-30.1.log",
@@ -301,11 +342,38 @@ func TestResolveFilepath(t *testing.T) {
 			currentVersion: 2,
 			tz: parseLocation("Europe/Moscow"),
 		},
+		{
+			expected: "/tmp/logs/test_log-2018-01-30T14.1.log",
+			prefix: "test_log",
+			dir: "/tmp/logs",
+			currentTime: parseTime(testTimeFormat, "2018-01-30T14-59-05.000"),
+			currentVersion: 1,
+			interval: Hourly,
+			tz: nil,
+		},
+		{
+			expected: "/tmp/logs/test_log-2018-01-30T14-45.1.log",
+			prefix: "test_log",
+			dir: "/tmp/logs",
+			currentTime: parseTime(testTimeFormat, "2018-01-30T14-59-05.000"),
+			currentVersion: 1,
+			interval: 15 * time.Minute,
+			tz: nil,
+		},
+		{
+			expected: "/tmp/logs/test_log-2018-01-29.1.log",
+			prefix: "test_log",
+			dir: "/tmp/logs",
+			currentTime: parseTime(dateSuffix, "2018-02-01"),
+			currentVersion: 1,
+			interval: Weekly,
+			tz: nil,
+		},
 	}
 
 	for _, tc := range tt {
 	    t.Run(tc.expected, func(t *testing.T) {
-			filepath := resolveFilepath(tc.prefix, tc.dir, tc.currentTime, tc.currentVersion, tc.tz)
+			filepath := resolveFilepath(tc.dir, mustFilenameTemplate(DefaultFilenameTemplate, tc.prefix, "localhost", newPeriod(tc.interval), tc.tz), tc.currentTime, tc.currentVersion)
 			assert.Equal(t, tc.expected, filepath)
 	    })
 	}
@@ -4,6 +4,8 @@ go 1.14
 
 require (
 	github.com/aws/aws-sdk-go v1.33.11
+	github.com/klauspost/compress v1.11.13
+	github.com/pierrec/lz4/v4 v4.1.11
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.6.1
 )
@@ -0,0 +1,156 @@
+package juggler
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// journal is a list of files kept in the log directory, so that what happened
+// to them is known to the next run, e.g. an outbox of files on their way to
+// the remote storage or the files which are processed already
+type journal struct {
+	path string
+	dir  string
+	name string
+	op   Op
+
+	mu      sync.Mutex
+	entries map[string]bool
+}
+
+// newOutbox journals files which are on their way to the remote storage, so that
+// files compressed but not uploaded before the process exited are picked up by the next run
+func newOutbox(dir, prefix string) *journal {
+	return newJournal(dir, "."+prefix+".outbox", "outbox", OpUpload)
+}
+
+// newProcessedJournal journals files which stay in the log directory after they
+// went through the pipeline, so that the next run does not process them again
+func newProcessedJournal(dir, prefix string) *journal {
+	return newJournal(dir, "."+prefix+".processed", "journal", OpHook)
+}
+
+func newJournal(dir, file, name string, op Op) *journal {
+	return &journal{
+		path:    filepath.Join(dir, file),
+		dir:     dir,
+		name:    name,
+		op:      op,
+		entries: make(map[string]bool),
+	}
+}
+
+// load reads the entries left by previous runs
+func (o *journal) load() ([]string, error) {
+	f, err := os.Open(o.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, opError(o.op, o.path, errors.Wrapf(err, "could not open %s %s", o.name, o.path), true)
+	}
+
+	defer f.Close()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var paths []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		path := filepath.Join(o.dir, filepath.FromSlash(line))
+		if !o.entries[path] {
+			o.entries[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, opError(o.op, o.path, errors.Wrapf(err, "could not read %s %s", o.name, o.path), true)
+	}
+
+	return paths, nil
+}
+
+// replace swaps the entry of a file for the entry of what the file became,
+// an empty path adds or removes an entry. The journal is not rewritten
+// if nothing changes.
+func (o *journal) replace(old, new string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if (old == "" || !o.entries[old]) && (new == "" || o.entries[new]) {
+		return nil
+	}
+
+	if old != "" {
+		delete(o.entries, old)
+	}
+
+	if new != "" {
+		o.entries[new] = true
+	}
+
+	return o.save()
+}
+
+// save rewrites the journal atomically, it is removed once empty
+func (o *journal) save() error {
+	if len(o.entries) == 0 {
+		if err := os.Remove(o.path); err != nil && !os.IsNotExist(err) {
+			return opError(o.op, o.path, errors.Wrapf(err, "could not remove %s %s", o.name, o.path), true)
+		}
+
+		return nil
+	}
+
+	lines := make([]string, 0, len(o.entries))
+	for path := range o.entries {
+		rel, err := filepath.Rel(o.dir, path)
+		if err != nil {
+			return opError(o.op, o.path, errors.Wrapf(err, "file %s is outside of %s", path, o.dir), true)
+		}
+
+		lines = append(lines, filepath.ToSlash(rel))
+	}
+
+	sort.Strings(lines)
+
+	tmp, err := ioutil.TempFile(o.dir, filepath.Base(o.path)+".tmp")
+	if err != nil {
+		return opError(o.op, o.path, errors.Wrapf(err, "could not create %s %s", o.name, o.path), true)
+	}
+
+	_, err = tmp.WriteString(strings.Join(lines, "\n") + "\n")
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), o.path)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return opError(o.op, o.path, errors.Wrapf(err, "could not write %s %s", o.name, o.path), true)
+	}
+
+	return nil
+}
@@ -1,55 +1,94 @@
 package juggler
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"github.com/denismitr/juggler/codec"
 	"github.com/pkg/errors"
 	"io"
 	"os"
-	"regexp"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	dateSuffix          = "2006-01-02"
 	defaultMaxMegabytes = 50
+	defaultMaxBackups   = 5
 	defaultExt          = ".log"
 )
 
 var _ io.WriteCloser = (*Juggler)(nil)
 
-var createFormat = func(prefix string) *regexp.Regexp {
-	return regexp.MustCompile("^" + prefix + `-(?P<date>\d{4}-\d{2}-\d{2})\.(?P<version>\d{1,4})\.log$`)
-}
-
 type nowFunc func() time.Time
 
 var (
 	osStat      = os.Stat
+	osHostname  = os.Hostname
 	megabyte    = 1024 * 1024
 )
 
 type Juggler struct {
+	// accessed atomically, kept first for 64-bit alignment
+	dropped uint64
+
 	directory string
 	prefix    string
+	template  string
+	symlink   string
 
 	maxFilesize int
-	maxBackups  int
+	retention   retention
+	retentionSet bool
+	period      period
 	timezone    *time.Location
-	compression bool
-	uploader    uploader
+	compression  bool
+	codec        codec.Codec
+	uploader      ContextUploader
+	keepUploaded  bool
+	uploadRetry   retryPolicy
+	uploadTimeout time.Duration
+	uploadCtx     context.Context
+	cancelUploads context.CancelFunc
+	hooks        []PostRotationHook
 
 	closeCh        chan struct{}
+	doneCh         chan struct{}
+	shutdownErrs   []error
+	finalRotation  bool
+	rotatedCh      chan string
 	errCh          chan error
-	errorObservers []chan error
+	errorObservers []*Subscription
+	errorHandler   ErrorHandler
+	errorBuffer    int
+	emu            sync.RWMutex
 	nextTick       time.Duration
+	checkInterval  time.Duration
+	checkDue       int32
 	nowFunc        nowFunc
-	format         *regexp.Regexp
+	naming         *filenameTemplate
+	counters       *counters
+
+	bufferSize    int
+	flushInterval time.Duration
+	queueSize     int
+	dropOnFull    bool
+	queue         chan writeRequest
+	drained       chan struct{}
+
+	qmu    sync.RWMutex
+	closed bool
 
 	cmu sync.RWMutex
 
+	buffer          *bufio.Writer
 	currentFilepath string
 	currentSize     int64
 	currentTime     time.Time
+	currentEnd      time.Time
 	currentFile     *os.File
 	currentVersion  int
 }
@@ -58,140 +97,332 @@ func New(prefix string, dir string, cfgs ...Configurator) *Juggler {
 	j := &Juggler{
 		prefix:         prefix,
 		directory:      dir,
+		template:       DefaultFilenameTemplate,
 		currentVersion: 1,
 		maxFilesize:    defaultMaxMegabytes,
-		maxBackups:     5,
+		queueSize:      defaultQueueSize,
 		closeCh:        make(chan struct{}),
+		doneCh:         make(chan struct{}),
+		rotatedCh:      make(chan string, 64),
 		errCh:          make(chan error),
-		nextTick:       5 * time.Second,
+		nextTick:       time.Minute,
+		checkInterval:  time.Second,
+		period:         newPeriod(Daily),
 		timezone:       time.UTC,
 		compression:    false,
-		format:         createFormat(prefix),
-		errorObservers: make([]chan error, 0),
+		codec:          codec.Gzip(gzip.DefaultCompression),
+		errorObservers: make([]*Subscription, 0),
+		errorBuffer:    defaultErrorBuffer,
 		nowFunc:        time.Now,
+		counters:       &counters{},
+		uploadTimeout:  defaultUploadTimeout,
+		uploadRetry: retryPolicy{
+			maxAttempts: defaultUploadAttempts,
+			minBackoff:  defaultMinBackoff,
+			maxBackoff:  defaultMaxBackoff,
+		},
 	}
 
 	for _, cfg := range cfgs {
 		cfg(j)
 	}
 
+	// compressed files were kept for good before retention covered them,
+	// so without any rule given they still are
+	if !j.retentionSet && !j.compression {
+		j.retention.maxBackups = defaultMaxBackups
+	}
+
+	j.uploadCtx, j.cancelUploads = context.WithCancel(context.Background())
+
+	host, err := osHostname()
+	if err != nil {
+		host = "localhost"
+	}
+
+	j.naming = mustFilenameTemplate(j.template, j.prefix, host, j.period, j.timezone)
+	j.naming.recognize(j.codec.Extension())
+	j.currentVersion = latestVersion(j.directory, j.naming, j.nowFunc)
+
+	now := j.nowFunc()
+	j.currentTime = j.period.start(now, j.timezone)
+	j.currentEnd = j.period.end(j.currentTime, j.timezone)
+	j.currentFilepath = resolveFilepath(j.directory, j.naming, now, j.currentVersion)
+
 	go j.watch()
 
-	j.currentFilepath = resolveFilepath(j.prefix, j.directory, j.nowFunc(), j.currentVersion, j.timezone)
+	if j.bufferSize > 0 {
+		j.queue = make(chan writeRequest, j.queueSize)
+		j.drained = make(chan struct{})
+		go j.drain()
+	}
 
 	return j
 }
 
-func (j *Juggler) NotifyOnError(errCh chan error) {
-	j.errorObservers = append(j.errorObservers, errCh)
-}
-
 func (j *Juggler) Write(p []byte) (int, error) {
 	ln := len(p)
 	if int64(ln) > j.maxSize() {
-		return 0, errors.Errorf("cannot write %d bytes at once", ln)
+		return 0, opError(OpWrite, "", errors.Errorf("cannot write %d bytes at once", ln), false)
 	}
 
-	if err := j.juggle(ln); err != nil {
-		return 0, err
+	if j.queue != nil {
+		return j.enqueue(p)
 	}
 
-	n, err := j.currentFile.Write(p)
+	j.qmu.RLock()
+	defer j.qmu.RUnlock()
 
-	j.cmu.Lock()
-	j.currentSize += int64(n)
-	j.cmu.Unlock()
+	if j.closed {
+		return 0, opError(OpWrite, "", ErrClosed, false)
+	}
 
-	return n, err
+	return j.write(p)
 }
 
-func (j *Juggler) juggle(n int) error {
-	currentFilepath, size, exists, err := j.resolveCurrentFile()
-	if err != nil {
-		return errors.Wrapf(err, "error getting stats for %s", currentFilepath)
+func (j *Juggler) write(p []byte) (int, error) {
+	j.cmu.Lock()
+	defer j.cmu.Unlock()
+
+	if err := j.juggle(len(p)); err != nil {
+		return 0, err
 	}
 
-	if !exists {
-		return j.create(currentFilepath)
+	var n int
+	var err error
+
+	if j.buffer != nil {
+		n, err = j.buffer.Write(p)
+	} else {
+		n, err = j.currentFile.Write(p)
 	}
 
-	j.cmu.RLock()
-	needsJuggling := size+int64(n) >= j.maxSize() || j.currentSize+int64(n) > j.maxSize()
-	j.cmu.RUnlock()
+	j.currentSize += int64(n)
+
+	atomic.AddUint64(&j.counters.writes, 1)
+	atomic.AddUint64(&j.counters.bytesWritten, uint64(n))
+
+	return n, opError(OpWrite, j.currentFilepath, err, false)
+}
 
-	if needsJuggling {
-		if err := j.close(); err != nil {
-			return err
+// juggle makes sure the current file can take n more bytes. The tracked size is relied upon
+// while the current period lasts, the file system is looked at only when a file has to be
+// rotated or opened, and when the periodic check is due.
+func (j *Juggler) juggle(n int) error {
+	now := j.nowFunc()
+	checkDue := atomic.LoadInt32(&j.checkDue) == 1
+
+	if j.currentFile != nil && !checkDue && !now.Before(j.currentTime) && now.Before(j.currentEnd) {
+		if j.currentSize+int64(n) <= j.maxSize() {
+			return nil
 		}
 
-		j.cmu.Lock()
-		j.currentVersion += 1
-		j.cmu.Unlock()
-		return j.juggle(n)
+		return j.rotate(n)
 	}
 
-	if j.currentFilepath == currentFilepath && j.currentFile != nil && j.currentSize == size {
-		return nil
-	}
+	atomic.StoreInt32(&j.checkDue, 0)
 
-	j.cmu.Lock()
-	f, err := os.OpenFile(currentFilepath, os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		return errors.Wrapf(err, "could not open file %s", currentFilepath)
+	// every new period starts counting versions from scratch
+	if start := j.period.start(now, j.timezone); !start.Equal(j.currentTime) {
+		j.currentTime = start
+		j.currentEnd = j.period.end(start, j.timezone)
+		j.currentVersion = 1
+
+		if j.currentFile != nil {
+			previous := j.currentFilepath
+			if err := j.close(); err != nil {
+				return err
+			}
+
+			j.notifyRotated(previous)
+		}
 	}
 
-	j.currentFilepath = currentFilepath
-	j.currentFile = f
-	j.currentSize = size
+	return j.resolve(n)
+}
 
-	j.cmu.Unlock()
+// rotate closes the current file and switches to the next version
+func (j *Juggler) rotate(n int) error {
+	previous := j.currentFilepath
+	if err := j.close(); err != nil {
+		return err
+	}
 
-	return nil
+	j.currentVersion += 1
+	j.notifyRotated(previous)
+
+	return j.resolve(n)
 }
 
-func (j *Juggler) resolveCurrentFile() (currentFilepath string, size int64, exists bool, err error) {
-	j.cmu.RLock()
-	defer j.cmu.RUnlock()
+// resolve finds the first version of the current period which can take n more bytes
+// and opens it, or creates it if it does not exist yet
+func (j *Juggler) resolve(n int) error {
+	for {
+		path := resolveFilepath(j.directory, j.naming, j.currentTime, j.currentVersion)
+
+		info, err := osStat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return j.create(path)
+			}
 
-	currentFilepath = resolveFilepath(j.prefix, j.directory, j.nowFunc(), j.currentVersion, j.timezone)
-	info, statErr := osStat(currentFilepath)
+			return opError(OpRotate, path, errors.Wrapf(err, "error getting stats for %s", path), false)
+		}
+
+		// the current file might have been moved away or replaced by someone else
+		current := path == j.currentFilepath && j.currentFile != nil && j.isCurrent(info)
 
-	if statErr != nil {
-		if os.IsNotExist(statErr) {
-			exists = false
+		if current {
+			// somebody else might have written to the file as well
+			j.currentSize = info.Size() + j.buffered()
 		} else {
-			err = statErr
+			j.currentSize = info.Size()
 		}
-	} else {
-		exists = true
-		size = info.Size()
+
+		if j.currentSize+int64(n) > j.maxSize() {
+			if current {
+				return j.rotate(n)
+			}
+
+			// a full file left from a previous run is not written to anymore
+			j.currentVersion += 1
+			j.notifyRotated(path)
+			continue
+		}
+
+		if current {
+			return nil
+		}
+
+		return j.open(path, info.Size())
 	}
+}
 
-	return
+// isCurrent tells whether info describes the file currently written to
+func (j *Juggler) isCurrent(info os.FileInfo) bool {
+	opened, err := j.currentFile.Stat()
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(opened, info)
 }
 
-func (j *Juggler) create(filepath string) error {
+// Reopen closes the current file and opens the file the current name points to,
+// creating it if needed. It is meant to be called e.g. on SIGHUP after the current
+// file was moved or deleted by logrotate or an operator.
+func (j *Juggler) Reopen() error {
+	j.qmu.RLock()
+	defer j.qmu.RUnlock()
+
+	if j.closed {
+		return opError(OpRotate, "", ErrClosed, false)
+	}
+
 	j.cmu.Lock()
 	defer j.cmu.Unlock()
 
-	err := os.MkdirAll(j.directory, 0755)
+	if err := j.close(); err != nil {
+		return err
+	}
+
+	return j.juggle(0)
+}
+
+func (j *Juggler) open(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
-		return errors.Wrapf(err, "cannot create new directory %s", j.directory)
+		return opError(OpRotate, path, errors.Wrapf(err, "could not open file %s", path), false)
+	}
+
+	if err := j.close(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	j.currentFilepath = path
+	j.currentFile = f
+	j.currentSize = size
+
+	j.attachBuffer()
+	j.linkCurrent()
+
+	return nil
+}
+
+func (j *Juggler) create(path string) error {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return opError(OpRotate, path, errors.Wrapf(err, "cannot create new directory %s", dir), false)
+	}
+
+	if err := j.close(); err != nil {
+		return err
 	}
 
 	mode := os.FileMode(0600)
-	f, err := os.OpenFile(filepath, os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_TRUNC, mode)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_TRUNC, mode)
 	if err != nil {
-		return errors.Wrapf(err, "cannot create currentFile %s at %s", filepath, j.directory)
+		return opError(OpRotate, path, errors.Wrapf(err, "cannot create currentFile %s at %s", path, j.directory), false)
 	}
 
-	j.currentFilepath = filepath
+	j.currentFilepath = path
 	j.currentFile = f
 	j.currentSize = 0
 
+	j.attachBuffer()
+	j.linkCurrent()
+
 	return nil
 }
 
+// linkCurrent points the symlink, if one is configured, to the current file
+func (j *Juggler) linkCurrent() {
+	if j.symlink == "" {
+		return
+	}
+
+	link := filepath.Join(j.directory, j.symlink)
+	if err := replaceSymlink(link, j.currentFilepath); err != nil {
+		j.reportError(opError(OpRotate, link, err, false))
+	}
+}
+
+// activeFile returns the path of the file being written to
+func (j *Juggler) activeFile() string {
+	j.cmu.RLock()
+	defer j.cmu.RUnlock()
+
+	return j.currentFilepath
+}
+
+// notifyRotated hands a closed file over to storage right away, if storage
+// is busy the file is left for the periodic sweep
+func (j *Juggler) notifyRotated(path string) {
+	atomic.AddUint64(&j.counters.rotations, 1)
+
+	mark := rotatedMark(j.directory, j.prefix)
+	if err := markRotated(mark, j.directory, path); err != nil {
+		j.reportError(opError(OpRotate, mark, err, false))
+	}
+
+	select {
+	case j.rotatedCh <- path:
+	default:
+	}
+}
+
+// reportError delivers errors from the write path without blocking it
+func (j *Juggler) reportError(err error) {
+	go func() {
+		select {
+		case j.errCh <- err:
+		case <-j.closeCh:
+		}
+	}()
+}
+
 func (j *Juggler) maxSize() int64 {
 	return int64(j.maxFilesize) * int64(megabyte)
 }
@@ -201,8 +432,20 @@ func (j *Juggler) close() error {
 		return nil
 	}
 
+	if j.buffer != nil {
+		err := j.buffer.Flush()
+		j.buffer = nil
+
+		if err != nil {
+			_ = j.currentFile.Close()
+			j.currentFile = nil
+			return opError(OpWrite, j.currentFilepath, errors.Wrapf(err, "could not flush buffer to %s", j.currentFilepath), false)
+		}
+	}
+
 	if err := j.currentFile.Close(); err != nil {
-		return errors.Wrapf(err, "could not close currentFile %s", j.currentFilepath)
+		j.currentFile = nil
+		return opError(OpWrite, j.currentFilepath, errors.Wrapf(err, "could not close currentFile %s", j.currentFilepath), false)
 	}
 
 	j.currentFile = nil
@@ -212,46 +455,48 @@ func (j *Juggler) close() error {
 
 func (j *Juggler) watch() {
 	tick := time.NewTicker(j.nextTick)
-	backupRunCh := make(chan struct{})
+	sweepCh := make(chan struct{}, 1)
+
+	var checkCh <-chan time.Time
+	if j.checkInterval > 0 {
+		check := time.NewTicker(j.checkInterval)
+		defer check.Stop()
+		checkCh = check.C
+	}
 
 	storage := j.createStorage()
+	storageDone := make(chan struct{})
 
-	go storage.start(backupRunCh, j.errCh)
+	go func() {
+		storage.start(sweepCh, j.rotatedCh, j.errCh)
+		close(storageDone)
+	}()
+
+	// leftovers from previous runs are picked up right away
+	sweepCh <- struct{}{}
 
 loop:
 	for {
 		select {
 		case <-tick.C:
-			backupRunCh <- struct{}{}
+			select {
+			case sweepCh <- struct{}{}:
+			default:
+			}
+		case <-checkCh:
+			atomic.StoreInt32(&j.checkDue, 1)
 		case <-j.closeCh:
-			close(backupRunCh)
 			break loop
 		case err := <-j.errCh:
-			for _, c := range j.errorObservers {
-				select {
-				case c <- err:
-				}
-			}
+			j.dispatch(err)
 		}
 	}
 
 	tick.Stop()
+	j.finish(sweepCh, storageDone)
 }
 
+// Close is Shutdown without a deadline
 func (j *Juggler) Close() error {
-	j.cmu.Lock()
-	defer func() {
-		j.currentFilepath = ""
-		j.currentFile = nil
-		j.currentSize = 0
-		j.cmu.Unlock()
-	}()
-
-	if j.currentFile != nil {
-		j.currentFile.Close()
-	}
-
-	close(j.closeCh)
-
-	return nil
+	return j.Shutdown(context.Background())
 }
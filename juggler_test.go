@@ -1,13 +1,19 @@
 package juggler
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
 	"github.com/denismitr/juggler/cloud"
+	"github.com/denismitr/juggler/codec"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -98,6 +104,218 @@ func TestJugglingDuringWrite(t *testing.T) {
 	assert.True(t, ok)
 }
 
+func TestRotationInterval(t *testing.T) {
+	dir := makeTestDir(randomString(20), t)
+	defer os.RemoveAll(dir)
+
+	now := parseTime(testTimeFormat, "2020-01-01T10-59-59.000")
+	nowFunc := func() time.Time { return now }
+
+	j := New("test_log", dir, WithRotationInterval(Hourly), withNowFunc(nowFunc))
+	defer j.Close()
+
+	first := []byte("first hour")
+	_, err := j.Write(first)
+	assert.NoError(t, err)
+
+	now = now.Add(time.Second)
+
+	second := []byte("second hour")
+	_, err = j.Write(second)
+	assert.NoError(t, err)
+
+	ok, err := expectFileToContain(filepath.Join(dir, "test_log-2020-01-01T10.1.log"), first)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = expectFileToContain(filepath.Join(dir, "test_log-2020-01-01T11.1.log"), second)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestRotationIntervalNotDividingADay(t *testing.T) {
+	uf := uncompressedIdenticalTestFileFactory("test_log", "previous day")
+
+	cleanUp, dir, err := createFakeLogFiles(randomString(20), uf("2020-10-11T21", 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer cleanUp()
+
+	nowFunc := createNowFunc(testTimeFormat, "2020-10-12T00-30-00.000")
+
+	j := New("test_log", dir, WithRotationInterval(7*time.Hour), withNowFunc(nowFunc))
+	defer j.Close()
+
+	entry := []byte("new day")
+	_, err = j.Write(entry)
+	assert.NoError(t, err)
+
+	// the last period of the previous day is shorter, but a period of its own
+	ok, err := expectFileToContain(filepath.Join(dir, "test_log-2020-10-12T00.1.log"), entry)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestSymlinkFollowsCurrentFile(t *testing.T) {
+	nowFunc := createNowFunc(dateSuffix, "2018-01-30")
+	megabyte = 1
+
+	dir := makeTestDir(randomString(15), t)
+	defer os.RemoveAll(dir)
+
+	j := New("test_log", dir, WithMaxMegabytes(20), WithSymlink("test_log.log"), withNowFunc(nowFunc))
+	defer j.Close()
+
+	link := filepath.Join(dir, "test_log.log")
+
+	first := []byte("first entry")
+	_, err := j.Write(first)
+	assert.NoError(t, err)
+
+	target, err := os.Readlink(link)
+	assert.NoError(t, err)
+	assert.Equal(t, "test_log-2018-01-30.1.log", target)
+
+	second := []byte("second entry")
+	_, err = j.Write(second)
+	assert.NoError(t, err)
+
+	target, err = os.Readlink(link)
+	assert.NoError(t, err)
+	assert.Equal(t, "test_log-2018-01-30.2.log", target)
+
+	ok, err := expectFileToContain(link, second)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestWritesDoNotStatFiles(t *testing.T) {
+	nowFunc := createNowFunc(dateSuffix, "2020-01-01")
+	megabyte = 1024 * 1024
+
+	dir := makeTestDir(randomString(20), t)
+	defer os.RemoveAll(dir)
+
+	var stats int32
+	osStat = func(name string) (os.FileInfo, error) {
+		atomic.AddInt32(&stats, 1)
+		return os.Stat(name)
+	}
+
+	defer func() {
+		osStat = os.Stat
+	}()
+
+	j := New("test_log", dir, WithFileCheckInterval(0), withNowFunc(nowFunc))
+	defer j.Close()
+
+	for i := 0; i < 100; i++ {
+		_, err := j.Write([]byte("entry\n"))
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&stats))
+}
+
+func TestExternalChangesAreDetected(t *testing.T) {
+	nowFunc := createNowFunc(dateSuffix, "2020-01-01")
+	megabyte = 1
+
+	dir := makeTestDir(randomString(20), t)
+	defer os.RemoveAll(dir)
+
+	j := New("test_log", dir, WithMaxMegabytes(30), WithFileCheckInterval(50*time.Millisecond), withNowFunc(nowFunc))
+	defer j.Close()
+
+	first := filepath.Join(dir, "test_log-2020-01-01.1.log")
+
+	_, err := j.Write([]byte("0123456789"))
+	assert.NoError(t, err)
+
+	f, err := os.OpenFile(first, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.Write([]byte("external entry\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	<-time.After(100 * time.Millisecond)
+
+	_, err = j.Write([]byte("0123456789"))
+	assert.NoError(t, err)
+
+	ok, err := expectFileToContain(filepath.Join(dir, "test_log-2020-01-01.2.log"), []byte("0123456789"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestReopen(t *testing.T) {
+	nowFunc := createNowFunc(dateSuffix, "2020-01-01")
+	megabyte = 1024 * 1024
+
+	dir := makeTestDir(randomString(20), t)
+	defer os.RemoveAll(dir)
+
+	j := New("test_log", dir, WithFileCheckInterval(0), withNowFunc(nowFunc))
+	defer j.Close()
+
+	current := filepath.Join(dir, "test_log-2020-01-01.1.log")
+	moved := filepath.Join(dir, "moved.log")
+
+	_, err := j.Write([]byte("before move\n"))
+	assert.NoError(t, err)
+
+	if err := os.Rename(current, moved); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, j.Reopen())
+
+	_, err = j.Write([]byte("after move\n"))
+	assert.NoError(t, err)
+
+	ok, err := expectFileToContain(moved, []byte("before move\n"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = expectFileToContain(current, []byte("after move\n"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestDeletedFileIsDetected(t *testing.T) {
+	nowFunc := createNowFunc(dateSuffix, "2020-01-01")
+	megabyte = 1024 * 1024
+
+	dir := makeTestDir(randomString(20), t)
+	defer os.RemoveAll(dir)
+
+	j := New("test_log", dir, WithFileCheckInterval(50*time.Millisecond), withNowFunc(nowFunc))
+	defer j.Close()
+
+	current := filepath.Join(dir, "test_log-2020-01-01.1.log")
+
+	_, err := j.Write([]byte("before delete\n"))
+	assert.NoError(t, err)
+
+	if err := os.Remove(current); err != nil {
+		t.Fatal(err)
+	}
+
+	<-time.After(100 * time.Millisecond)
+
+	_, err = j.Write([]byte("after delete\n"))
+	assert.NoError(t, err)
+
+	ok, err := expectFileToContain(current, []byte("after delete\n"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
 func TestCompressAfterJuggle(t *testing.T) {
 	prefix := "test_log"
 	content := "uncompressed fake - log - content"
@@ -161,6 +379,124 @@ func TestCompressAfterJuggle(t *testing.T) {
 	assert.NoFileExists(t, prevFile)
 }
 
+func TestCompressRightAfterRotation(t *testing.T) {
+	nowFunc := createNowFunc(dateSuffix, "2018-01-30")
+	megabyte = 1
+
+	dir := makeTestDir(randomString(15), t)
+	defer os.RemoveAll(dir)
+
+	j := New("test_log", dir, WithCompression(), WithMaxMegabytes(20), WithNextTick(time.Hour), withNowFunc(nowFunc))
+	defer j.Close()
+
+	// the initial sweep finds nothing, so only the rotation event can trigger compression
+	<-time.After(100 * time.Millisecond)
+
+	_, err := j.Write([]byte("first entry"))
+	assert.NoError(t, err)
+
+	_, err = j.Write([]byte("second entry"))
+	assert.NoError(t, err)
+
+	first := filepath.Join(dir, "test_log-2018-01-30.1.log")
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(gzippedName(first))
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoFileExists(t, first)
+	assert.FileExists(t, filepath.Join(dir, "test_log-2018-01-30.2.log"))
+}
+
+func TestCompressClosedVersionsOfToday(t *testing.T) {
+	prefix := "test_log"
+	content := "uncompressed fake - log - content"
+	uf := uncompressedIdenticalTestFileFactory(prefix, content)
+	nowFunc := createNowFunc(dateSuffix, "2018-01-30")
+
+	cleanUp, dir, err := createFakeLogFiles(
+		randomString(14),
+		uf("2018-01-30", 1),
+		uf("2018-01-30", 2),
+		uf("2018-01-30", 3),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer cleanUp()
+
+	j := New(prefix, dir, WithCompression(), WithNextTick(time.Hour), withNowFunc(nowFunc))
+	defer j.Close()
+
+	active := filepath.Join(dir, "test_log-2018-01-30.3.log")
+	assert.Equal(t, active, j.activeFile())
+
+	for _, v := range []int{1, 2} {
+		closed := filepath.Join(dir, fmt.Sprintf("test_log-2018-01-30.%d.log", v))
+
+		assert.Eventually(t, func() bool {
+			_, err := os.Stat(gzippedName(closed))
+			return err == nil
+		}, time.Second, 10*time.Millisecond)
+
+		assert.NoFileExists(t, closed)
+	}
+
+	entry := []byte("next entry")
+	_, err = j.Write(entry)
+	assert.NoError(t, err)
+
+	ok, err := expectFileToContain(active, append([]byte(content), entry...))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoFileExists(t, gzippedName(active))
+}
+
+func TestCompressWithCodec(t *testing.T) {
+	prefix := "test_log"
+	uf := uncompressedIdenticalTestFileFactory(prefix, "uncompressed fake - log - content")
+	cf := compressedIdenticalTestFileFactory(prefix, "compressed fake - log - content")
+	nowFunc := createNowFunc(dateSuffix, "2018-01-30")
+
+	cleanUp, dir, err := createFakeLogFiles(
+		randomString(14),
+		cf("2018-01-26", 1),
+		uf("2018-01-28", 1),
+		uf("2018-01-29", 1),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer cleanUp()
+
+	j := New(
+		prefix,
+		dir,
+		WithCompressionCodec(codec.Zstd(3)),
+		WithMaxBackups(2),
+		WithNextTick(250 * time.Millisecond),
+		withNowFunc(nowFunc),
+	)
+
+	defer j.Close()
+
+	<-time.After(800 * time.Millisecond)
+
+	for _, date := range []string{"2018-01-28", "2018-01-29"} {
+		fp := filepath.Join(dir, fmt.Sprintf("%s-%s.1.log", prefix, date))
+		assert.FileExists(t, fp+".zst")
+		assert.NoFileExists(t, fp)
+	}
+
+	// files compressed with other codecs are recognized as backups too
+	assert.NoFileExists(t, filepath.Join(dir, gzippedName(fmt.Sprintf("%s-%s.1.log", prefix, "2018-01-26"))))
+}
+
 func TestCompressAndUploadAfterJuggle(t *testing.T) {
 	prefix := "test_log"
 	content := "uncompressed fake - log - content"
@@ -248,6 +584,487 @@ func TestCompressAndUploadAfterJuggle(t *testing.T) {
 	assert.NoFileExists(t, prevFile)
 }
 
+func TestStoragePipeline(t *testing.T) {
+	prefix := "test_log"
+	uf := uncompressedIdenticalTestFileFactory(prefix, "uncompressed fake - log - content")
+	nowFunc := createNowFunc(dateSuffix, "2018-01-30")
+
+	t.Run("upload uncompressed", func(t *testing.T) {
+		cleanUp, dir, err := createFakeLogFiles(randomString(14), uf("2018-01-27", 1), uf("2018-01-28", 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer cleanUp()
+
+		u := &fakeUploader{}
+		j := New(prefix, dir, WithCloudUploader(u), WithNextTick(250 * time.Millisecond), withNowFunc(nowFunc))
+		defer j.Close()
+
+		<-time.After(800 * time.Millisecond)
+
+		assert.ElementsMatch(t, []string{"test_log-2018-01-27.1.log", "test_log-2018-01-28.1.log"}, u.files())
+		assert.NoFileExists(t, filepath.Join(dir, "test_log-2018-01-27.1.log"))
+		assert.NoFileExists(t, filepath.Join(dir, "test_log-2018-01-28.1.log"))
+	})
+
+	t.Run("checksums computed during compression are uploaded", func(t *testing.T) {
+		cleanUp, dir, err := createFakeLogFiles(randomString(14), uf("2018-01-28", 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer cleanUp()
+
+		u := &fakeChecksumUploader{}
+		j := New(prefix, dir, WithCompressionAndCloudUploader(u), WithKeepUploaded(), WithNextTick(250 * time.Millisecond), withNowFunc(nowFunc))
+		defer j.Close()
+
+		<-time.After(500 * time.Millisecond)
+
+		compressed, err := ioutil.ReadFile(filepath.Join(dir, "test_log-2018-01-28.1.log.gz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		md5sum := md5.Sum(compressed)
+		sha256sum := sha256.Sum256(compressed)
+
+		assert.Equal(t, append(md5sum[:], sha256sum[:]...), u.checksum("test_log-2018-01-28.1.log.gz"))
+	})
+
+	t.Run("compress, upload and keep some locally", func(t *testing.T) {
+		cleanUp, dir, err := createFakeLogFiles(
+			randomString(14),
+			uf("2018-01-25", 1),
+			uf("2018-01-26", 1),
+			uf("2018-01-27", 1),
+			uf("2018-01-28", 1),
+		)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer cleanUp()
+
+		u := &fakeUploader{}
+		j := New(
+			prefix,
+			dir,
+			WithCompressionAndCloudUploader(u),
+			WithKeepUploaded(),
+			WithMaxBackups(3),
+			WithNextTick(250 * time.Millisecond),
+			withNowFunc(nowFunc),
+		)
+
+		defer j.Close()
+
+		<-time.After(800 * time.Millisecond)
+
+		assert.ElementsMatch(t, []string{
+			"test_log-2018-01-25.1.log.gz",
+			"test_log-2018-01-26.1.log.gz",
+			"test_log-2018-01-27.1.log.gz",
+			"test_log-2018-01-28.1.log.gz",
+		}, u.files())
+
+		assert.NoFileExists(t, filepath.Join(dir, "test_log-2018-01-25.1.log.gz"))
+
+		for _, date := range []string{"2018-01-26", "2018-01-27", "2018-01-28"} {
+			assert.FileExists(t, filepath.Join(dir, gzippedName(fmt.Sprintf("%s-%s.1.log", prefix, date))))
+		}
+	})
+
+	t.Run("kept files are not processed again after restarts", func(t *testing.T) {
+		cleanUp, dir, err := createFakeLogFiles(randomString(14), uf("2018-01-27", 1), uf("2018-01-28", 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer cleanUp()
+
+		var calls int32
+		hook := PostRotationFunc(func(f RotatedFile) (RotatedFile, error) {
+			atomic.AddInt32(&calls, 1)
+			return f, nil
+		})
+
+		u := &fakeUploader{}
+
+		for i := 0; i < 3; i++ {
+			j := New(
+				prefix,
+				dir,
+				WithCloudUploader(u),
+				WithKeepUploaded(),
+				WithPostRotationHook(hook),
+				WithNextTick(100 * time.Millisecond),
+				withNowFunc(nowFunc),
+			)
+
+			<-time.After(300 * time.Millisecond)
+			assert.NoError(t, j.Close())
+		}
+
+		assert.ElementsMatch(t, []string{"test_log-2018-01-27.1.log", "test_log-2018-01-28.1.log"}, u.files())
+		assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+		assert.FileExists(t, filepath.Join(dir, "test_log-2018-01-27.1.log"))
+		assert.FileExists(t, filepath.Join(dir, "test_log-2018-01-28.1.log"))
+	})
+}
+
+func TestFailedUploadsAreRetried(t *testing.T) {
+	prefix := "test_log"
+	uf := uncompressedIdenticalTestFileFactory(prefix, "uncompressed fake - log - content")
+	nowFunc := createNowFunc(dateSuffix, "2018-01-30")
+
+	t.Run("archives are kept until the upload succeeds", func(t *testing.T) {
+		cleanUp, dir, err := createFakeLogFiles(randomString(14), uf("2018-01-27", 1), uf("2018-01-28", 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer cleanUp()
+
+		u := &fakeUploader{}
+		u.fail(errors.New("s3 is down"))
+
+		errCh := make(chan error, 10)
+		j := New(
+			prefix,
+			dir,
+			WithCompressionAndCloudUploader(u),
+			WithMaxBackups(1),
+			WithUploadRetries(0, 100*time.Millisecond, 100*time.Millisecond),
+			withNowFunc(nowFunc),
+		)
+
+		j.NotifyOnError(errCh)
+		defer j.Close()
+
+		<-time.After(300 * time.Millisecond)
+
+		assert.Empty(t, u.files())
+		assert.NotEmpty(t, errCh)
+
+		// retention does not remove archives waiting to be uploaded
+		assert.FileExists(t, filepath.Join(dir, "test_log-2018-01-27.1.log.gz"))
+		assert.FileExists(t, filepath.Join(dir, "test_log-2018-01-28.1.log.gz"))
+
+		u.fail(nil)
+
+		<-time.After(500 * time.Millisecond)
+
+		assert.ElementsMatch(t, []string{"test_log-2018-01-27.1.log.gz", "test_log-2018-01-28.1.log.gz"}, u.files())
+		assert.NoFileExists(t, filepath.Join(dir, "test_log-2018-01-27.1.log.gz"))
+		assert.NoFileExists(t, filepath.Join(dir, "test_log-2018-01-28.1.log.gz"))
+	})
+
+	t.Run("archives are kept when the attempts run out", func(t *testing.T) {
+		cleanUp, dir, err := createFakeLogFiles(randomString(14), uf("2018-01-28", 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer cleanUp()
+
+		u := &fakeUploader{}
+		u.fail(errors.New("s3 is down"))
+
+		errCh := make(chan error, 10)
+		j := New(
+			prefix,
+			dir,
+			WithCompressionAndCloudUploader(u),
+			WithUploadRetries(2, 50*time.Millisecond, 50*time.Millisecond),
+			withNowFunc(nowFunc),
+		)
+
+		j.NotifyOnError(errCh)
+		defer j.Close()
+
+		<-time.After(400 * time.Millisecond)
+
+		u.fail(nil)
+
+		<-time.After(200 * time.Millisecond)
+
+		assert.Empty(t, u.files())
+		assert.FileExists(t, filepath.Join(dir, "test_log-2018-01-28.1.log.gz"))
+
+		if assert.Len(t, errCh, 2) {
+			<-errCh
+			assert.Contains(t, (<-errCh).Error(), "giving up uploading")
+		}
+	})
+}
+
+func TestUploadCancellation(t *testing.T) {
+	prefix := "test_log"
+	uf := uncompressedIdenticalTestFileFactory(prefix, "uncompressed fake - log - content")
+	nowFunc := createNowFunc(dateSuffix, "2018-01-30")
+
+	t.Run("uploads time out", func(t *testing.T) {
+		cleanUp, dir, err := createFakeLogFiles(randomString(14), uf("2018-01-28", 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer cleanUp()
+
+		u := &blockingUploader{}
+
+		errCh := make(chan error, 10)
+		j := New(
+			prefix,
+			dir,
+			WithCompression(),
+			WithContextUploader(u),
+			WithUploadTimeout(50*time.Millisecond),
+			WithUploadRetries(0, time.Minute, time.Minute),
+			withNowFunc(nowFunc),
+		)
+
+		j.NotifyOnError(errCh)
+		defer j.Close()
+
+		select {
+		case err := <-errCh:
+			assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		case <-time.After(time.Second):
+			t.Fatal("upload did not time out")
+		}
+
+		assert.FileExists(t, filepath.Join(dir, "test_log-2018-01-28.1.log.gz"))
+	})
+
+	t.Run("shutdown cancels uploads", func(t *testing.T) {
+		cleanUp, dir, err := createFakeLogFiles(randomString(14), uf("2018-01-28", 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer cleanUp()
+
+		u := &blockingUploader{}
+		j := New(prefix, dir, WithCompression(), WithContextUploader(u), WithUploadTimeout(0), withNowFunc(nowFunc))
+
+		<-time.After(100 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		err = j.Shutdown(ctx)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+		assert.Eventually(t, func() bool {
+			errs := u.errors()
+			return len(errs) == 1 && errs[0] == context.Canceled
+		}, time.Second, 10*time.Millisecond)
+
+		assert.FileExists(t, filepath.Join(dir, "test_log-2018-01-28.1.log.gz"))
+	})
+
+	t.Run("plain uploaders are adapted", func(t *testing.T) {
+		u := &fakeUploader{}
+		a := AdaptUploader(u)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		assert.Equal(t, context.Canceled, a.UploadWithContext(ctx, "test_log-2018-01-28.1.log.gz"))
+		assert.Empty(t, u.files())
+
+		assert.NoError(t, a.UploadWithContext(context.Background(), "test_log-2018-01-28.1.log.gz"))
+		assert.Equal(t, []string{"test_log-2018-01-28.1.log.gz"}, u.files())
+
+		var s3 Uploader = &cloud.S3GzipCloud{}
+		assert.Same(t, s3, AdaptUploader(s3))
+	})
+}
+
+func TestPostRotationHooks(t *testing.T) {
+	prefix := "test_log"
+	content := "uncompressed fake - log - content"
+	uf := uncompressedIdenticalTestFileFactory(prefix, content)
+	nowFunc := createNowFunc(dateSuffix, "2018-01-30")
+
+	cleanUp, dir, err := createFakeLogFiles(randomString(14), uf("2018-01-28", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer cleanUp()
+
+	archive := makeTestDir(randomString(14), t)
+	defer os.RemoveAll(archive)
+
+	seen := make(chan RotatedFile, 1)
+
+	inspect := PostRotationFunc(func(f RotatedFile) (RotatedFile, error) {
+		seen <- f
+		return f, nil
+	})
+
+	move := PostRotationFunc(func(f RotatedFile) (RotatedFile, error) {
+		return RotatedFile{}, os.Rename(f.Path, filepath.Join(archive, filepath.Base(f.Path)))
+	})
+
+	j := New(
+		prefix,
+		dir,
+		WithCompression(),
+		WithPostRotationHook(inspect, move),
+		WithNextTick(250 * time.Millisecond),
+		withNowFunc(nowFunc),
+	)
+
+	defer j.Close()
+
+	select {
+	case f := <-seen:
+		assert.Equal(t, filepath.Join(dir, "test_log-2018-01-28.2.log.gz"), f.Path)
+		assert.Equal(t, parseTime(dateSuffix, "2018-01-28"), f.Date)
+		assert.Equal(t, 2, f.Version)
+		assert.True(t, f.Size > 0)
+	case <-time.After(time.Second):
+		t.Fatal("hook was not called")
+	}
+
+	<-time.After(100 * time.Millisecond)
+
+	assert.NoFileExists(t, filepath.Join(dir, "test_log-2018-01-28.2.log.gz"))
+	assert.FileExists(t, filepath.Join(archive, "test_log-2018-01-28.2.log.gz"))
+}
+
+func TestFailedHooksAreRetried(t *testing.T) {
+	prefix := "test_log"
+	uf := uncompressedIdenticalTestFileFactory(prefix, "uncompressed fake - log - content")
+	nowFunc := createNowFunc(dateSuffix, "2018-01-30")
+
+	cleanUp, dir, err := createFakeLogFiles(randomString(14), uf("2018-01-27", 1), uf("2018-01-28", 1), uf("2018-01-29", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer cleanUp()
+
+	var failing int32 = 1
+	var calls int32
+
+	hook := PostRotationFunc(func(f RotatedFile) (RotatedFile, error) {
+		atomic.AddInt32(&calls, 1)
+
+		if atomic.LoadInt32(&failing) == 1 {
+			return RotatedFile{}, errors.New("index is down")
+		}
+
+		return f, nil
+	})
+
+	u := &fakeUploader{}
+	j := New(
+		prefix,
+		dir,
+		WithCompressionAndCloudUploader(u),
+		WithPostRotationHook(hook),
+		WithMaxBackups(1),
+		WithNextTick(100*time.Millisecond),
+		withNowFunc(nowFunc),
+	)
+
+	defer j.Close()
+
+	<-time.After(350 * time.Millisecond)
+
+	// compressed archives failing the hook are neither pruned nor uploaded
+	assert.Empty(t, u.files())
+	assert.True(t, atomic.LoadInt32(&calls) > 3)
+	assert.FileExists(t, filepath.Join(dir, "test_log-2018-01-27.1.log.gz"))
+	assert.FileExists(t, filepath.Join(dir, "test_log-2018-01-28.1.log.gz"))
+	assert.FileExists(t, filepath.Join(dir, "test_log-2018-01-29.1.log.gz"))
+
+	atomic.StoreInt32(&failing, 0)
+
+	<-time.After(250 * time.Millisecond)
+
+	assert.ElementsMatch(t, []string{
+		"test_log-2018-01-27.1.log.gz",
+		"test_log-2018-01-28.1.log.gz",
+		"test_log-2018-01-29.1.log.gz",
+	}, u.files())
+}
+
+func TestHooksAreNotCalledConcurrently(t *testing.T) {
+	prefix := "test_log"
+	uf := uncompressedIdenticalTestFileFactory(prefix, "uncompressed fake - log - content")
+	nowFunc := createNowFunc(dateSuffix, "2018-01-30")
+
+	cleanUp, dir, err := createFakeLogFiles(randomString(14), uf("2018-01-27", 1), uf("2018-01-28", 1), uf("2018-01-29", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer cleanUp()
+
+	var running, overlaps, calls int32
+
+	hook := PostRotationFunc(func(f RotatedFile) (RotatedFile, error) {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+
+		<-time.After(20 * time.Millisecond)
+
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&calls, 1)
+
+		return f, nil
+	})
+
+	j := New(prefix, dir, WithCompression(), WithPostRotationHook(hook), withNowFunc(nowFunc))
+	defer j.Close()
+
+	<-time.After(300 * time.Millisecond)
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&overlaps))
+}
+
+func TestRetentionIsAppliedOnSweeps(t *testing.T) {
+	nowFunc := createNowFunc(dateSuffix, "2018-01-30")
+	megabyte = 1
+
+	dir := makeTestDir(randomString(15), t)
+	defer os.RemoveAll(dir)
+
+	j := New("test_log", dir, WithMaxMegabytes(10), WithMaxBackups(1), WithNextTick(300*time.Millisecond), withNowFunc(nowFunc))
+	defer j.Close()
+
+	// the first sweep has run already, rotations do not trigger pruning
+	<-time.After(50 * time.Millisecond)
+
+	for i := 0; i < 4; i++ {
+		_, err := j.Write([]byte("0123456789"))
+		assert.NoError(t, err)
+	}
+
+	<-time.After(50 * time.Millisecond)
+
+	for v := 1; v <= 3; v++ {
+		assert.FileExists(t, filepath.Join(dir, fmt.Sprintf("test_log-2018-01-30.%d.log", v)))
+	}
+
+	<-time.After(400 * time.Millisecond)
+
+	assert.NoFileExists(t, filepath.Join(dir, "test_log-2018-01-30.1.log"))
+	assert.NoFileExists(t, filepath.Join(dir, "test_log-2018-01-30.2.log"))
+	assert.FileExists(t, filepath.Join(dir, "test_log-2018-01-30.3.log"))
+	assert.FileExists(t, filepath.Join(dir, "test_log-2018-01-30.4.log"))
+}
+
 func TestRemoveTooManyBackups(t *testing.T) {
 	prefix := "test_log"
 	uf := uncompressedIdenticalTestFileFactory(prefix, "uncompressed fake - log - content")
@@ -299,7 +1116,7 @@ func TestRemoveTooManyBackups(t *testing.T) {
 		}
 	})
 
-	t.Run("no versions and compressed files should be left untouched", func(t *testing.T) {
+	t.Run("compressed files are counted as backups too", func(t *testing.T) {
 		cleanUp, dir, err := createFakeLogFiles(
 			randomString(14),
 			uf("2018-01-16", 1),
@@ -310,7 +1127,7 @@ func TestRemoveTooManyBackups(t *testing.T) {
 			uf("2018-01-21", 1),
 			uf("2018-01-22", 1),
 			uf("2018-01-23", 1),
-			uf("2018-01-25", 1),
+			cf("2018-01-25", 1),
 			uf("2018-01-26", 1),
 			uf("2018-01-29", 1),
 		)
@@ -326,9 +1143,10 @@ func TestRemoveTooManyBackups(t *testing.T) {
 
 		<-time.After(800 * time.Millisecond)
 
-		shouldExist := []string{"2018-01-22", "2018-01-23", "2018-01-25", "2018-01-26", "2018-01-29"}
-		compressedShouldExist := []string{"2018-01-17", "2018-01-19", "2018-01-20"}
+		shouldExist := []string{"2018-01-22", "2018-01-23", "2018-01-26", "2018-01-29"}
+		compressedShouldExist := []string{"2018-01-25"}
 		shouldNotExist := []string{"2018-01-16", "2018-01-18", "2018-01-21"}
+		compressedShouldNotExist := []string{"2018-01-17", "2018-01-19", "2018-01-20"}
 
 		for _, fn := range shouldExist {
 			fp := filepath.Join(dir, fmt.Sprintf("%s-%s.1.log", prefix, fn))
@@ -344,6 +1162,70 @@ func TestRemoveTooManyBackups(t *testing.T) {
 			fp := filepath.Join(dir, gzippedName(fmt.Sprintf("%s-%s.1.log", prefix, fn)))
 			assert.FileExists(t, fp)
 		}
+
+		for _, fn := range compressedShouldNotExist {
+			fp := filepath.Join(dir, gzippedName(fmt.Sprintf("%s-%s.1.log", prefix, fn)))
+			assert.NoFileExists(t, fp)
+		}
+	})
+
+	t.Run("retention applies with compression enabled", func(t *testing.T) {
+		cleanUp, dir, err := createFakeLogFiles(
+			randomString(14),
+			cf("2018-01-20", 1),
+			cf("2018-01-21", 1),
+			uf("2018-01-22", 1),
+			uf("2018-01-23", 1),
+		)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer cleanUp()
+
+		j := New(prefix, dir, WithCompression(), WithMaxBackups(3), WithNextTick(250 * time.Millisecond), withNowFunc(nowFunc))
+		defer j.Close()
+
+		<-time.After(800 * time.Millisecond)
+
+		compressedShouldExist := []string{"2018-01-21", "2018-01-22", "2018-01-23"}
+
+		for _, fn := range compressedShouldExist {
+			fp := filepath.Join(dir, gzippedName(fmt.Sprintf("%s-%s.1.log", prefix, fn)))
+			assert.FileExists(t, fp)
+		}
+
+		assert.NoFileExists(t, filepath.Join(dir, gzippedName(fmt.Sprintf("%s-%s.1.log", prefix, "2018-01-20"))))
+	})
+
+	t.Run("compressed files are kept without retention rules", func(t *testing.T) {
+		cleanUp, dir, err := createFakeLogFiles(
+			randomString(14),
+			cf("2018-01-20", 1),
+			cf("2018-01-21", 1),
+			cf("2018-01-22", 1),
+			cf("2018-01-23", 1),
+			cf("2018-01-24", 1),
+			uf("2018-01-25", 1),
+			uf("2018-01-26", 1),
+		)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer cleanUp()
+
+		j := New(prefix, dir, WithCompression(), WithNextTick(250 * time.Millisecond), withNowFunc(nowFunc))
+		defer j.Close()
+
+		<-time.After(800 * time.Millisecond)
+
+		for _, fn := range []string{"2018-01-20", "2018-01-21", "2018-01-22", "2018-01-23", "2018-01-24", "2018-01-25", "2018-01-26"} {
+			fp := filepath.Join(dir, gzippedName(fmt.Sprintf("%s-%s.1.log", prefix, fn)))
+			assert.FileExists(t, fp)
+		}
 	})
 
 	t.Run("today file is not counted", func(t *testing.T) {
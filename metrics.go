@@ -0,0 +1,75 @@
+package juggler
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PublishExpvar publishes Stats under the name among expvar variables, served
+// at /debug/vars. Like expvar.Publish it panics if the name is taken already.
+func (j *Juggler) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return j.Stats()
+	}))
+}
+
+// MetricsHandler serves Stats in the Prometheus text format,
+// metrics are labeled with the prefix of the log files
+func (j *Juggler) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		j.writeMetrics(w)
+	})
+}
+
+type metric struct {
+	name  string
+	kind  string
+	help  string
+	value float64
+}
+
+func (j *Juggler) writeMetrics(w io.Writer) {
+	s := j.Stats()
+	labels := fmt.Sprintf(`prefix="%s"`, escapeLabel(j.prefix))
+
+	metrics := []metric{
+		{"juggler_bytes_written_total", "counter", "Bytes written to log files.", float64(s.BytesWritten)},
+		{"juggler_writes_total", "counter", "Writes to log files.", float64(s.Writes)},
+		{"juggler_dropped_writes_total", "counter", "Writes dropped since the write queue was full.", float64(s.DroppedWrites)},
+		{"juggler_rotations_total", "counter", "Log files rotated.", float64(s.Rotations)},
+		{"juggler_current_version", "gauge", "Version of the current log file.", float64(s.CurrentVersion)},
+		{"juggler_compressions_total", "counter", "Log files compressed.", float64(s.Compressions)},
+		{"juggler_compression_failures_total", "counter", "Log files which failed to be compressed.", float64(s.CompressionFailures)},
+		{"juggler_compressed_bytes_total", "counter", "Bytes of log files before compression.", float64(s.BytesCompressed)},
+		{"juggler_compressed_output_bytes_total", "counter", "Bytes of log files after compression.", float64(s.BytesAfterCompression)},
+		{"juggler_compression_ratio", "gauge", "Size of compressed files to their size before compression.", s.CompressionRatio},
+		{"juggler_uploads_total", "counter", "Log files uploaded.", float64(s.Uploads)},
+		{"juggler_upload_failures_total", "counter", "Failed upload attempts.", float64(s.UploadFailures)},
+		{"juggler_uploaded_bytes_total", "counter", "Bytes of log files uploaded.", float64(s.BytesUploaded)},
+		{"juggler_pruned_total", "counter", "Log files removed by the retention rules.", float64(s.Pruned)},
+	}
+
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s{%s} %s\n", m.name, m.help, m.name, m.kind, m.name, labels, formatValue(m.value))
+	}
+
+	const latency = "juggler_upload_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time spent on upload attempts.\n# TYPE %s summary\n", latency, latency)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", latency, labels, formatValue(s.UploadDuration.Seconds()))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", latency, labels, s.Uploads+s.UploadFailures)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
@@ -0,0 +1,221 @@
+package juggler
+
+import (
+	"github.com/denismitr/juggler/codec"
+	"github.com/pkg/errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultFilenameTemplate produces names like my-log-2020-10-11.1.log
+const DefaultFilenameTemplate = "{prefix}-{date}.{version}" + defaultExt
+
+var templateToken = regexp.MustCompile(`\{(\w+)\}`)
+
+var tokenPatterns = map[string]string{
+	"yyyy":    `\d{4}`,
+	"mm":      `\d{2}`,
+	"dd":      `\d{2}`,
+	"HH":      `\d{2}`,
+	"MM":      `\d{2}`,
+	"version": `\d+`,
+}
+
+var tokenLayouts = map[string]string{
+	"yyyy": "2006",
+	"mm":   "01",
+	"dd":   "02",
+	"HH":   "15",
+	"MM":   "04",
+}
+
+// filenameTemplate generates log file names relative to the log directory
+// and parses them back, so that rotated files can be found and ordered
+type filenameTemplate struct {
+	template string
+	prefix   string
+	host     string
+	period   period
+	tz       *time.Location
+	format   *regexp.Regexp
+	nested   bool
+
+	// extensions of compressed files, e.g. ".gz"
+	extensions []string
+}
+
+func newFilenameTemplate(template, prefix, host string, p period, tz *time.Location) (*filenameTemplate, error) {
+	if tz == nil {
+		tz = time.UTC
+	}
+
+	f := &filenameTemplate{
+		template: template,
+		prefix:   prefix,
+		host:     host,
+		period:   p,
+		tz:       tz,
+		nested:   strings.Contains(template, "/"),
+
+		extensions: codec.Extensions(),
+	}
+
+	tokens := make(map[string]bool)
+	pattern := "^"
+	last := 0
+
+	for _, loc := range templateToken.FindAllStringSubmatchIndex(template, -1) {
+		token := template[loc[2]:loc[3]]
+		pattern += regexp.QuoteMeta(template[last:loc[0]])
+		last = loc[1]
+
+		switch token {
+		case "prefix":
+			pattern += regexp.QuoteMeta(prefix)
+		case "host":
+			pattern += regexp.QuoteMeta(host)
+		case "date":
+			pattern += group(token, layoutPattern(p.layout), tokens[token])
+		default:
+			tp, ok := tokenPatterns[token]
+			if !ok {
+				return nil, errors.Errorf("unknown token {%s} in filename template %s", token, template)
+			}
+
+			pattern += group(token, tp, tokens[token])
+		}
+
+		tokens[token] = true
+	}
+
+	pattern += regexp.QuoteMeta(template[last:]) + "$"
+
+	if !tokens["version"] {
+		return nil, errors.Errorf("filename template %s must contain {version}", template)
+	}
+
+	if !tokens["date"] {
+		required := []string{"yyyy", "mm", "dd"}
+		if p.interval%Daily != 0 {
+			required = append(required, "HH")
+		}
+
+		if p.interval%time.Hour != 0 {
+			required = append(required, "MM")
+		}
+
+		for _, token := range required {
+			if !tokens[token] {
+				return nil, errors.Errorf("filename template %s must contain {date} or {%s} for the rotation interval", template, token)
+			}
+		}
+	}
+
+	format, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not compile filename template %s", template)
+	}
+
+	f.format = format
+
+	return f, nil
+}
+
+func mustFilenameTemplate(template, prefix, host string, p period, tz *time.Location) *filenameTemplate {
+	f, err := newFilenameTemplate(template, prefix, host, p, tz)
+	if err != nil {
+		panic(err)
+	}
+
+	return f
+}
+
+// recognize adds the extension of a custom codec to the known ones
+func (f *filenameTemplate) recognize(ext string) {
+	for _, known := range f.extensions {
+		if known == ext {
+			return
+		}
+	}
+
+	f.extensions = append(f.extensions, ext)
+}
+
+// filename returns a slash separated name for the period containing t
+func (f *filenameTemplate) filename(t time.Time, version int) string {
+	start := f.period.start(t, f.tz)
+
+	return templateToken.ReplaceAllStringFunc(f.template, func(token string) string {
+		name := token[1 : len(token)-1]
+
+		switch name {
+		case "prefix":
+			return f.prefix
+		case "host":
+			return f.host
+		case "date":
+			return start.Format(f.period.layout)
+		case "version":
+			return strconv.Itoa(version)
+		default:
+			return start.Format(tokenLayouts[name])
+		}
+	})
+}
+
+// parse extracts the period start and the version from a slash separated name
+func (f *filenameTemplate) parse(name string) (time.Time, int, bool) {
+	matches := f.format.FindStringSubmatch(name)
+	if matches == nil {
+		return time.Time{}, 0, false
+	}
+
+	values := make(map[string]string)
+	for i, n := range f.format.SubexpNames() {
+		if i != 0 && n != "" {
+			values[n] = matches[i]
+		}
+	}
+
+	version, _ := strconv.Atoi(values["version"])
+
+	if date, ok := values["date"]; ok {
+		t, err := time.ParseInLocation(f.period.layout, date, f.tz)
+		if err != nil {
+			return time.Time{}, 0, false
+		}
+
+		return t, version, true
+	}
+
+	year, _ := strconv.Atoi(values["yyyy"])
+	month, _ := strconv.Atoi(values["mm"])
+	day, _ := strconv.Atoi(values["dd"])
+	hour, _ := strconv.Atoi(values["HH"])
+	minute, _ := strconv.Atoi(values["MM"])
+
+	return time.Date(year, time.Month(month), day, hour, minute, 0, 0, f.tz), version, true
+}
+
+func group(name, pattern string, repeated bool) string {
+	if repeated {
+		return "(?:" + pattern + ")"
+	}
+
+	return "(?P<" + name + ">" + pattern + ")"
+}
+
+func layoutPattern(layout string) string {
+	var b strings.Builder
+	for _, r := range layout {
+		if r >= '0' && r <= '9' {
+			b.WriteString(`\d`)
+		} else {
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	return b.String()
+}
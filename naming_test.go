@@ -0,0 +1,121 @@
+package juggler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFilenameTemplate(t *testing.T) {
+	tt := []struct {
+		name     string
+		template string
+		interval time.Duration
+		t        time.Time
+		version  int
+		expected string
+	}{
+		{
+			name:     "default",
+			template: DefaultFilenameTemplate,
+			interval: Daily,
+			t:        parseTime(testTimeFormat, "2020-10-11T14-15-16.000"),
+			version:  3,
+			expected: "app-2020-10-11.3.log",
+		},
+		{
+			name:     "nested with host",
+			template: "{prefix}/{yyyy}/{mm}/{dd}/{host}-{version}.jsonl",
+			interval: Daily,
+			t:        parseTime(testTimeFormat, "2020-10-11T14-15-16.000"),
+			version:  2,
+			expected: "app/2020/10/11/web-1-2.jsonl",
+		},
+		{
+			name:     "hourly with separate tokens",
+			template: "{yyyy}{mm}{dd}-{HH}/{prefix}.{version}.log",
+			interval: Hourly,
+			t:        parseTime(testTimeFormat, "2020-10-11T14-15-16.000"),
+			version:  1,
+			expected: "20201011-14/app.1.log",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			naming, err := newFilenameTemplate(tc.template, "app", "web-1", newPeriod(tc.interval), time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			name := naming.filename(tc.t, tc.version)
+			assert.Equal(t, tc.expected, name)
+
+			start, version, ok := naming.parse(name)
+			assert.True(t, ok)
+			assert.Equal(t, tc.version, version)
+			assert.Equal(t, naming.period.start(tc.t, time.UTC), start)
+
+			_, _, ok = naming.parse(name + ".gz")
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestInvalidFilenameTemplate(t *testing.T) {
+	tt := []struct {
+		template string
+		interval time.Duration
+	}{
+		{template: "{prefix}-{date}.log", interval: Daily},
+		{template: "{prefix}-{yyyy}-{mm}.{version}.log", interval: Daily},
+		{template: "{prefix}-{yyyy}-{mm}-{dd}.{version}.log", interval: Hourly},
+		{template: "{prefix}-{date}-{unknown}.{version}.log", interval: Daily},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.template, func(t *testing.T) {
+			_, err := newFilenameTemplate(tc.template, "app", "localhost", newPeriod(tc.interval), time.UTC)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNestedFilenameTemplate(t *testing.T) {
+	dir := makeTestDir(randomString(20), t)
+	defer os.RemoveAll(dir)
+
+	nowFunc := createNowFunc(dateSuffix, "2020-01-02")
+	template := "{prefix}/{yyyy}/{mm}/{dd}/{version}.jsonl"
+
+	old := filepath.Join(dir, "test_log", "2020", "01", "01", "1.jsonl")
+	if err := os.MkdirAll(filepath.Dir(old), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(old, []byte("old entry"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j := New("test_log", dir, WithFilenameTemplate(template), withNowFunc(nowFunc))
+	defer j.Close()
+
+	b := []byte("test log")
+	_, err := j.Write(b)
+	assert.NoError(t, err)
+
+	ok, err := expectFileToContain(filepath.Join(dir, "test_log", "2020", "01", "02", "1.jsonl"), b)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	lfs, err := scanBackups(dir, j.naming, nowFunc)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(lfs))
+	assert.Equal(t, old, lfs[0].fullPath())
+	assert.Equal(t, 1, lfs[0].periodsAgo)
+	assert.Equal(t, j.activeFile(), lfs[1].fullPath())
+	assert.Equal(t, 0, lfs[1].periodsAgo)
+}
@@ -0,0 +1,137 @@
+package juggler
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const defaultErrorBuffer = 64
+
+// ErrorHandler is called with every error, it is called from the housekeeping
+// goroutine and must return quickly
+type ErrorHandler func(err error)
+
+// Subscription delivers errors to a channel given to NotifyOnError. Errors are buffered
+// for every subscription, so that a slow observer neither blocks Juggler nor other
+// observers, errors which do not fit into the buffer are dropped and counted.
+type Subscription struct {
+	// accessed atomically, kept first for 64-bit alignment
+	dropped uint64
+
+	ch      chan error
+	queue   chan error
+	done    chan struct{}
+	closeCh chan struct{}
+	once    sync.Once
+	remove  func(s *Subscription)
+}
+
+// Unsubscribe stops the delivery of errors, the channel is not closed
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.remove(s)
+		close(s.done)
+	})
+}
+
+// Dropped returns the number of errors dropped because the observer did not keep up
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Subscription) offer(err error) {
+	select {
+	case s.queue <- err:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// forward delivers buffered errors in order, once the background work of a closed Juggler is done
+// it hands over whatever the observer takes without waiting
+func (s *Subscription) forward() {
+	for {
+		select {
+		case err := <-s.queue:
+			select {
+			case s.ch <- err:
+			case <-s.done:
+				return
+			case <-s.closeCh:
+				s.flush(err)
+				return
+			}
+		case <-s.done:
+			return
+		case <-s.closeCh:
+			s.flush()
+			return
+		}
+	}
+}
+
+func (s *Subscription) flush(pending ...error) {
+	for {
+		var err error
+		if len(pending) > 0 {
+			err, pending = pending[0], pending[1:]
+		} else {
+			select {
+			case err = <-s.queue:
+			default:
+				return
+			}
+		}
+
+		select {
+		case s.ch <- err:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// NotifyOnError subscribes the channel to errors of Juggler and of processing rotated files
+func (j *Juggler) NotifyOnError(errCh chan error) *Subscription {
+	s := &Subscription{
+		ch:      errCh,
+		queue:   make(chan error, j.errorBuffer),
+		done:    make(chan struct{}),
+		closeCh: j.doneCh,
+		remove:  j.unsubscribe,
+	}
+
+	j.emu.Lock()
+	j.errorObservers = append(j.errorObservers, s)
+	j.emu.Unlock()
+
+	go s.forward()
+
+	return s
+}
+
+func (j *Juggler) unsubscribe(s *Subscription) {
+	j.emu.Lock()
+	defer j.emu.Unlock()
+
+	for i, o := range j.errorObservers {
+		if o == s {
+			j.errorObservers = append(j.errorObservers[:i:i], j.errorObservers[i+1:]...)
+			return
+		}
+	}
+}
+
+// dispatch hands the error over to the handler and to every observer without blocking on them
+func (j *Juggler) dispatch(err error) {
+	if j.errorHandler != nil {
+		j.errorHandler(err)
+	}
+
+	j.emu.RLock()
+	defer j.emu.RUnlock()
+
+	for _, s := range j.errorObservers {
+		s.offer(err)
+	}
+}
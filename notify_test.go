@@ -0,0 +1,73 @@
+package juggler
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestErrorDelivery(t *testing.T) {
+	prefix := "test_log"
+
+	t.Run("slow observers do not block others", func(t *testing.T) {
+		dir := makeTestDir(randomString(14), t)
+		defer os.RemoveAll(dir)
+
+		var handled int32
+		j := New(prefix, dir, WithErrorBuffer(2), WithErrorHandler(func(err error) {
+			atomic.AddInt32(&handled, 1)
+		}))
+
+		defer j.Close()
+
+		abandoned := j.NotifyOnError(make(chan error))
+
+		fast := make(chan error, 10)
+		j.NotifyOnError(fast)
+
+		for i := 0; i < 5; i++ {
+			j.dispatch(errors.Errorf("error %d", i))
+
+			select {
+			case err := <-fast:
+				assert.EqualError(t, err, fmt.Sprintf("error %d", i))
+			case <-time.After(time.Second):
+				t.Fatal("errors were not delivered")
+			}
+		}
+
+		assert.Equal(t, int32(5), atomic.LoadInt32(&handled))
+
+		// one error is waiting to be sent, or about to, two are buffered
+		assert.Contains(t, []uint64{2, 3}, abandoned.Dropped())
+	})
+
+	t.Run("unsubscribe", func(t *testing.T) {
+		dir := makeTestDir(randomString(14), t)
+		defer os.RemoveAll(dir)
+
+		j := New(prefix, dir)
+		defer j.Close()
+
+		errCh := make(chan error, 10)
+		s := j.NotifyOnError(errCh)
+
+		j.dispatch(errors.New("first"))
+		assert.EqualError(t, <-errCh, "first")
+
+		s.Unsubscribe()
+		s.Unsubscribe()
+
+		j.dispatch(errors.New("second"))
+
+		select {
+		case err := <-errCh:
+			t.Fatalf("unexpected error after unsubscribe: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
@@ -1,6 +1,9 @@
 package juggler
 
-import "time"
+import (
+	"github.com/denismitr/juggler/codec"
+	"time"
+)
 
 type Configurator func(j *Juggler)
 
@@ -10,15 +13,63 @@ func WithMaxMegabytes(maxMegabytes int) Configurator {
 	}
 }
 
+// WithRotationInterval sets how often a new log file is started regardless of its size,
+// e.g. Hourly, 15 * time.Minute, Daily or Weekly. Intervals shorter than a day
+// are rounded down to whole minutes, longer ones to whole days.
+func WithRotationInterval(interval time.Duration) Configurator {
+	return func(j *Juggler) {
+		j.period = newPeriod(interval)
+	}
+}
+
+// WithFilenameTemplate changes the layout of log file names relative to the log directory.
+// Supported tokens are {prefix}, {host}, {date}, {yyyy}, {mm}, {dd}, {HH}, {MM} and {version},
+// e.g. "{prefix}/{yyyy}/{mm}/{dd}/{host}-{version}.jsonl". The template must contain {version}
+// and enough date tokens for the rotation interval, otherwise New panics.
+func WithFilenameTemplate(template string) Configurator {
+	return func(j *Juggler) {
+		j.template = template
+	}
+}
+
+// WithSymlink maintains a symlink with the given name in the log directory,
+// which always points to the file currently written to, e.g. for tail -F
+func WithSymlink(name string) Configurator {
+	return func(j *Juggler) {
+		j.symlink = name
+	}
+}
+
 func WithTimezone(tz *time.Location) Configurator {
 	return func(j *Juggler) {
 		j.timezone = tz
 	}
 }
 
+// WithMaxBackups limits the number of rotated files kept, compressed ones included,
+// zero or less keeps any number of them. Without any retention rule 5 files are kept,
+// or any number of them with compression.
 func WithMaxBackups(backups int) Configurator {
 	return func(j *Juggler) {
-		j.maxBackups = backups
+		j.retention.maxBackups = backups
+		j.retentionSet = true
+	}
+}
+
+// WithMaxAge removes rotated files which have not been written to for longer than age
+func WithMaxAge(age time.Duration) Configurator {
+	return func(j *Juggler) {
+		j.retention.maxAge = age
+		j.retentionSet = true
+	}
+}
+
+// WithMaxTotalBytes removes the oldest rotated files once all of them together
+// take more than the given number of bytes on disk
+func WithMaxTotalBytes(bytes int64) Configurator {
+	return func(j *Juggler) {
+		j.retention.maxBytes = bytes
+		j.retentionSet = true
 	}
 }
 
@@ -28,19 +79,141 @@ func WithCompression() Configurator {
 	}
 }
 
+// WithCompressionCodec enables compression with the given codec instead of the default gzip,
+// e.g. codec.Gzip(gzip.BestCompression), codec.Zstd(3) or codec.LZ4(0)
+func WithCompressionCodec(c codec.Codec) Configurator {
+	return func(j *Juggler) {
+		j.compression = true
+		j.codec = c
+	}
+}
+
+// WithNextTick sets how often the log directory is swept for rotated files
+// which were not processed right after rotation, e.g. left by a previous run
 func WithNextTick(nextTick time.Duration) Configurator {
 	return func(j *Juggler) {
 		j.nextTick = nextTick
 	}
 }
 
-func WithCompressionAndCloudUploader(uploader uploader) Configurator {
+func WithCompressionAndCloudUploader(uploader Uploader) Configurator {
 	return func(j *Juggler) {
 		j.compression = true
+		j.uploader = AdaptUploader(uploader)
+	}
+}
+
+// WithCloudUploader uploads rotated files, compressed ones if compression is enabled
+func WithCloudUploader(uploader Uploader) Configurator {
+	return func(j *Juggler) {
+		j.uploader = AdaptUploader(uploader)
+	}
+}
+
+// WithContextUploader uploads rotated files with an uploader which can be cancelled,
+// compressed ones if compression is enabled
+func WithContextUploader(uploader ContextUploader) Configurator {
+	return func(j *Juggler) {
 		j.uploader = uploader
 	}
 }
 
+// WithUploadTimeout limits how long a single upload attempt may take, ten minutes by default,
+// zero or less means no limit. Uploaders which are not a ContextUploader are not limited.
+func WithUploadTimeout(timeout time.Duration) Configurator {
+	return func(j *Juggler) {
+		j.uploadTimeout = timeout
+	}
+}
+
+// WithKeepUploaded keeps uploaded files locally, so they are removed by the retention rules only
+func WithKeepUploaded() Configurator {
+	return func(j *Juggler) {
+		j.keepUploaded = true
+	}
+}
+
+// WithUploadRetries sets how failed uploads are retried: up to maxAttempts times in total,
+// zero meaning no limit, waiting from minBackoff to maxBackoff between attempts.
+// Files are never removed before they are uploaded, also when the attempts run out.
+func WithUploadRetries(maxAttempts int, minBackoff, maxBackoff time.Duration) Configurator {
+	return func(j *Juggler) {
+		if maxBackoff < minBackoff {
+			maxBackoff = minBackoff
+		}
+
+		j.uploadRetry = retryPolicy{maxAttempts: maxAttempts, minBackoff: minBackoff, maxBackoff: maxBackoff}
+	}
+}
+
+// WithPostRotationHook adds custom processing of rotated files, hooks run in the given order
+// after compression and before upload
+func WithPostRotationHook(hooks ...PostRotationHook) Configurator {
+	return func(j *Juggler) {
+		j.hooks = append(j.hooks, hooks...)
+	}
+}
+
+// WithBufferedWrites makes writes asynchronous: entries are queued and written
+// through a buffer of the given size, which is flushed every flushInterval,
+// on rotation, on Flush and on Close
+func WithBufferedWrites(bufferSize int, flushInterval time.Duration) Configurator {
+	return func(j *Juggler) {
+		j.bufferSize = bufferSize
+		j.flushInterval = flushInterval
+	}
+}
+
+// WithQueueSize sets how many entries can wait to be written in buffered mode
+func WithQueueSize(size int) Configurator {
+	return func(j *Juggler) {
+		j.queueSize = size
+	}
+}
+
+// WithDropOnFullQueue drops entries instead of blocking when the queue is full,
+// see Dropped for the number of entries lost
+func WithDropOnFullQueue() Configurator {
+	return func(j *Juggler) {
+		j.dropOnFull = true
+	}
+}
+
+// WithFileCheckInterval sets how often the current file is looked at on the file system
+// to detect changes made by others, e.g. appending to it, moving or deleting it,
+// zero disables the periodic check
+func WithFileCheckInterval(interval time.Duration) Configurator {
+	return func(j *Juggler) {
+		j.checkInterval = interval
+	}
+}
+
+// WithErrorHandler calls the handler with every error, in addition to the channels
+// subscribed with NotifyOnError. The handler must not block.
+func WithErrorHandler(handler ErrorHandler) Configurator {
+	return func(j *Juggler) {
+		j.errorHandler = handler
+	}
+}
+
+// WithErrorBuffer sets how many errors are kept for every observer which does not
+// keep up, further errors are dropped, see Subscription.Dropped
+func WithErrorBuffer(size int) Configurator {
+	return func(j *Juggler) {
+		if size > 0 {
+			j.errorBuffer = size
+		}
+	}
+}
+
+// WithFinalRotation rotates the current file on Close and Shutdown, so that
+// it is compressed and uploaded before they return
+func WithFinalRotation() Configurator {
+	return func(j *Juggler) {
+		j.finalRotation = true
+	}
+}
+
 func withNowFunc(nowFunc nowFunc) Configurator {
 	return func(j *Juggler) {
 		j.nowFunc = nowFunc
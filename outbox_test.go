@@ -0,0 +1,79 @@
+package juggler
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOutbox(t *testing.T) {
+	prefix := "test_log"
+	cf := compressedIdenticalTestFileFactory(prefix, "compressed fake - log - content")
+	uf := uncompressedIdenticalTestFileFactory(prefix, "uncompressed fake - log - content")
+	nowFunc := createNowFunc(dateSuffix, "2018-01-30")
+
+	t.Run("failed uploads are journaled", func(t *testing.T) {
+		cleanUp, dir, err := createFakeLogFiles(randomString(14), uf("2018-01-27", 1), uf("2018-01-28", 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer cleanUp()
+
+		u := &fakeUploader{}
+		u.fail(errors.New("s3 is down"))
+
+		j := New(prefix, dir, WithCompressionAndCloudUploader(u), WithUploadRetries(0, time.Minute, time.Minute), withNowFunc(nowFunc))
+		defer j.Close()
+
+		<-time.After(300 * time.Millisecond)
+
+		b, err := ioutil.ReadFile(filepath.Join(dir, ".test_log.outbox"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, "test_log-2018-01-27.1.log.gz\ntest_log-2018-01-28.1.log.gz\n", string(b))
+	})
+
+	t.Run("journaled files are uploaded on start", func(t *testing.T) {
+		cleanUp, dir, err := createFakeLogFiles(
+			randomString(14),
+			cf("2018-01-26", 1),
+			cf("2018-01-27", 1),
+			uf("2018-01-28", 1),
+			cf("2018-01-29", 1),
+		)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer cleanUp()
+
+		// the 27th got compressed but the journal was not updated,
+		// the 28th did not get compressed, the 29th was never journaled
+		journal := "test_log-2018-01-26.1.log.gz\ntest_log-2018-01-27.1.log\ntest_log-2018-01-28.1.log\ngone.log.gz\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, ".test_log.outbox"), []byte(journal), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		u := &fakeUploader{}
+		j := New(prefix, dir, WithCompressionAndCloudUploader(u), withNowFunc(nowFunc))
+		defer j.Close()
+
+		<-time.After(300 * time.Millisecond)
+
+		assert.ElementsMatch(t, []string{
+			"test_log-2018-01-26.1.log.gz",
+			"test_log-2018-01-27.1.log.gz",
+			"test_log-2018-01-28.1.log.gz",
+		}, u.files())
+
+		assert.FileExists(t, filepath.Join(dir, "test_log-2018-01-29.1.log.gz"))
+		assert.NoFileExists(t, filepath.Join(dir, ".test_log.outbox"))
+	})
+}
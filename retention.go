@@ -0,0 +1,37 @@
+package juggler
+
+import (
+	"time"
+)
+
+// retention combines the rules deciding which backups are kept,
+// a backup violating any of the enabled rules is removed
+type retention struct {
+	maxBackups int
+	maxAge     time.Duration
+	maxBytes   int64
+}
+
+// expired returns the backups, ordered from the oldest to the newest, which must be removed
+func (r retention) expired(files []logFileMeta, now time.Time) []logFileMeta {
+	var result []logFileMeta
+	var total int64
+
+	for i := len(files) - 1; i >= 0; i-- {
+		f := files[i]
+		newer := len(files) - 1 - i
+		total += f.f.Size()
+
+		switch {
+		case r.maxBackups > 0 && newer >= r.maxBackups:
+		case r.maxAge > 0 && now.Sub(f.end) > r.maxAge:
+		case r.maxBytes > 0 && total > r.maxBytes:
+		default:
+			continue
+		}
+
+		result = append([]logFileMeta{f}, result...)
+	}
+
+	return result
+}
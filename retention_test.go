@@ -0,0 +1,96 @@
+package juggler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+type fakeFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (f fakeFileInfo) Size() int64 {
+	return f.size
+}
+
+func TestRetentionExpired(t *testing.T) {
+	now := parseTime(dateSuffix, "2018-01-30")
+	backup := func(date string, size int64) logFileMeta {
+		d := parseTime(dateSuffix, date)
+		return logFileMeta{path: date, date: d, end: d.Add(Daily), f: fakeFileInfo{size: size}}
+	}
+
+	files := []logFileMeta{
+		backup("2018-01-20", 100),
+		backup("2018-01-24", 100),
+		backup("2018-01-27", 100),
+		backup("2018-01-28", 100),
+		backup("2018-01-29", 100),
+	}
+
+	tt := []struct {
+		name      string
+		retention retention
+		expired   []string
+	}{
+		{name: "unlimited", retention: retention{}, expired: nil},
+		{name: "by count", retention: retention{maxBackups: 3}, expired: []string{"2018-01-20", "2018-01-24"}},
+		{name: "by age", retention: retention{maxAge: 3 * Daily}, expired: []string{"2018-01-20", "2018-01-24"}},
+		{name: "by total size", retention: retention{maxBytes: 250}, expired: []string{"2018-01-20", "2018-01-24", "2018-01-27"}},
+		{
+			name:      "combined",
+			retention: retention{maxBackups: 4, maxAge: 7 * Daily, maxBytes: 1000},
+			expired:   []string{"2018-01-20"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var expired []string
+			for _, f := range tc.retention.expired(files, now) {
+				expired = append(expired, f.path)
+			}
+
+			assert.Equal(t, tc.expired, expired)
+		})
+	}
+}
+
+func TestPruneWithMaxAge(t *testing.T) {
+	prefix := "test_log"
+	uf := uncompressedIdenticalTestFileFactory(prefix, "uncompressed fake - log - content")
+	cf := compressedIdenticalTestFileFactory(prefix, "compressed fake - log - content")
+
+	cleanUp, dir, err := createFakeLogFiles(
+		randomString(14),
+		cf("2018-01-20", 1),
+		uf("2018-01-26", 1),
+		cf("2018-01-27", 1),
+		uf("2018-01-29", 1),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer cleanUp()
+
+	nowFunc := createNowFunc(dateSuffix, "2018-01-30")
+	j := New(prefix, dir, WithMaxBackups(0), WithMaxAge(3*Daily), WithNextTick(250*time.Millisecond), withNowFunc(nowFunc))
+	defer j.Close()
+
+	<-time.After(800 * time.Millisecond)
+
+	files, err := scanLogFiles(dir, j.naming, nowFunc)
+	assert.NoError(t, err)
+
+	var dates []string
+	for _, f := range files {
+		dates = append(dates, f.date.Format(dateSuffix))
+	}
+
+	assert.Equal(t, []string{"2018-01-26", "2018-01-27", "2018-01-29"}, dates)
+}
@@ -0,0 +1,116 @@
+package juggler
+
+import (
+	"time"
+)
+
+const (
+	Hourly = time.Hour
+	Daily  = 24 * time.Hour
+	Weekly = 7 * Daily
+)
+
+const (
+	hourSuffix   = "2006-01-02T15"
+	minuteSuffix = "2006-01-02T15-04"
+)
+
+// multi-day periods are counted from a monday, so weekly rotation starts on mondays
+var periodEpoch = time.Date(1970, time.January, 5, 0, 0, 0, 0, time.UTC)
+
+type period struct {
+	interval time.Duration
+	layout   string
+}
+
+// newPeriod normalizes the rotation interval so that the start of every period
+// can be written to and read back from the file name without loss
+func newPeriod(interval time.Duration) period {
+	switch {
+	case interval <= 0:
+		return period{interval: Daily, layout: dateSuffix}
+	case interval >= Daily:
+		return period{interval: interval - interval%Daily, layout: dateSuffix}
+	case interval%time.Hour == 0:
+		return period{interval: interval, layout: hourSuffix}
+	case interval < time.Minute:
+		return period{interval: time.Minute, layout: minuteSuffix}
+	default:
+		return period{interval: interval - interval%time.Minute, layout: minuteSuffix}
+	}
+}
+
+func (p period) start(t time.Time, tz *time.Location) time.Time {
+	if tz == nil {
+		tz = time.UTC
+	}
+
+	t = t.In(tz)
+	y, m, d := t.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, tz)
+
+	if p.interval < Daily {
+		elapsed := t.Sub(midnight)
+		return midnight.Add(elapsed - elapsed%p.interval)
+	}
+
+	days := int(p.interval / Daily)
+	offset := (calendarDays(periodEpoch, midnight)%days + days) % days
+
+	return midnight.AddDate(0, 0, -offset)
+}
+
+// end returns the start of the period following the one starting at start
+func (p period) end(start time.Time, tz *time.Location) time.Time {
+	if tz == nil {
+		tz = time.UTC
+	}
+
+	start = start.In(tz)
+
+	if p.interval < Daily {
+		y, m, d := start.Date()
+		midnight := time.Date(y, m, d+1, 0, 0, 0, 0, tz)
+
+		if next := start.Add(p.interval); next.Before(midnight) {
+			return next
+		}
+
+		return midnight
+	}
+
+	return start.AddDate(0, 0, int(p.interval/Daily))
+}
+
+// between returns the number of whole periods passed from one time to the other. Periods
+// shorter than a day start over at midnight, intervals which do not divide a day leave
+// a shorter last period, so they are counted per day.
+func (p period) between(from, to time.Time, tz *time.Location) int {
+	from = p.start(from, tz)
+	to = p.start(to, tz)
+
+	if p.interval < Daily {
+		perDay := int((Daily + p.interval - 1) / p.interval)
+		return calendarDays(from, to)*perDay + p.index(to) - p.index(from)
+	}
+
+	return calendarDays(from, to) / int(p.interval/Daily)
+}
+
+// index returns the number of the period starting at start within its day
+func (p period) index(start time.Time) int {
+	y, m, d := start.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, start.Location())
+
+	return int(start.Sub(midnight) / p.interval)
+}
+
+func calendarDays(from, to time.Time) int {
+	fy, fm, fd := from.Date()
+	ty, tm, td := to.Date()
+
+	f := time.Date(fy, fm, fd, 0, 0, 0, 0, time.UTC)
+	t := time.Date(ty, tm, td, 0, 0, 0, 0, time.UTC)
+
+	return int(t.Sub(f).Hours() / 24)
+}
@@ -0,0 +1,99 @@
+package juggler
+
+import (
+	"context"
+	"github.com/pkg/errors"
+)
+
+// Shutdown stops accepting writes, writes out queued entries and closes the current file,
+// which is rotated and processed right away if WithFinalRotation is given. It then waits
+// for compression, hooks and uploads in progress, or until ctx is done, and returns what
+// went wrong meanwhile, an Errors value if more than one thing did. Uploads still in progress
+// then are cancelled, files which were not processed are picked up on the next start.
+func (j *Juggler) Shutdown(ctx context.Context) error {
+	j.qmu.Lock()
+	if j.closed {
+		j.qmu.Unlock()
+		return nil
+	}
+
+	j.closed = true
+
+	// queued entries are written before the file is closed
+	if j.queue != nil {
+		close(j.queue)
+		<-j.drained
+	}
+
+	j.qmu.Unlock()
+
+	var errs []error
+	if err := j.closeCurrent(); err != nil {
+		errs = append(errs, err)
+	}
+
+	close(j.closeCh)
+	defer j.cancelUploads()
+
+	select {
+	case <-j.doneCh:
+		errs = append(errs, j.shutdownErrs...)
+	case <-ctx.Done():
+		// uploads in progress are cancelled, the files are uploaded on the next start
+		errs = append(errs, opError(OpShutdown, j.directory, errors.Wrap(ctx.Err(), "background work is not done"), false))
+	}
+
+	return errorOf(errs)
+}
+
+// closeCurrent closes the current file and, when it is rotated on shutdown,
+// hands it over to storage unless nothing was written to it
+func (j *Juggler) closeCurrent() error {
+	j.cmu.Lock()
+	defer j.cmu.Unlock()
+
+	path := j.currentFilepath
+	written := j.currentFile != nil && j.currentSize > 0
+
+	err := j.close()
+
+	j.currentFile = nil
+	j.currentSize = 0
+
+	// storage leaves the file alone as long as it is the current one
+	if j.finalRotation {
+		j.currentFilepath = ""
+
+		if err == nil && written {
+			j.notifyRotated(path)
+		}
+	}
+
+	return err
+}
+
+// finish lets storage complete the work in progress, with a final sweep processing
+// the last file when it is rotated on shutdown. Errors keep being dispatched
+// and are collected for Shutdown until storage is done.
+func (j *Juggler) finish(sweepCh chan struct{}, storageDone <-chan struct{}) {
+	var finalSweep chan struct{}
+	if j.finalRotation {
+		finalSweep = sweepCh
+	} else {
+		close(sweepCh)
+	}
+
+	for {
+		select {
+		case finalSweep <- struct{}{}:
+			close(sweepCh)
+			finalSweep = nil
+		case err := <-j.errCh:
+			j.dispatch(err)
+			j.shutdownErrs = append(j.shutdownErrs, err)
+		case <-storageDone:
+			close(j.doneCh)
+			return
+		}
+	}
+}
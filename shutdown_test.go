@@ -0,0 +1,172 @@
+package juggler
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	prefix := "test_log"
+	nowFunc := createNowFunc(dateSuffix, "2018-01-30")
+
+	t.Run("the last file is compressed and uploaded", func(t *testing.T) {
+		dir := makeTestDir(randomString(14), t)
+		defer os.RemoveAll(dir)
+
+		u := &fakeUploader{}
+		j := New(prefix, dir, WithCompressionAndCloudUploader(u), WithFinalRotation(), withNowFunc(nowFunc))
+
+		_, err := j.Write([]byte("last words\n"))
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		require.NoError(t, j.Shutdown(ctx))
+
+		assert.Equal(t, []string{"test_log-2018-01-30.1.log.gz"}, u.files())
+		assert.NoFileExists(t, filepath.Join(dir, "test_log-2018-01-30.1.log"))
+		assert.Equal(t, "", j.Stats().CurrentFile)
+
+		_, err = j.Write([]byte("too late\n"))
+		assert.True(t, errors.Is(err, ErrClosed))
+		assert.NoError(t, j.Close())
+	})
+
+	t.Run("versions are not used again after restarts", func(t *testing.T) {
+		dir := makeTestDir(randomString(14), t)
+		defer os.RemoveAll(dir)
+
+		u := &fakeUploader{}
+
+		for i := 0; i < 3; i++ {
+			j := New(prefix, dir, WithCompressionAndCloudUploader(u), WithFinalRotation(), withNowFunc(nowFunc))
+
+			_, err := j.Write([]byte("last words\n"))
+			require.NoError(t, err)
+
+			require.NoError(t, j.Shutdown(context.Background()))
+		}
+
+		assert.Equal(t, []string{
+			"test_log-2018-01-30.1.log.gz",
+			"test_log-2018-01-30.2.log.gz",
+			"test_log-2018-01-30.3.log.gz",
+		}, u.files())
+	})
+
+	t.Run("the last file stays without final rotation", func(t *testing.T) {
+		dir := makeTestDir(randomString(14), t)
+		defer os.RemoveAll(dir)
+
+		u := &fakeUploader{}
+		j := New(prefix, dir, WithCompressionAndCloudUploader(u), withNowFunc(nowFunc))
+
+		_, err := j.Write([]byte("last words\n"))
+		require.NoError(t, err)
+
+		require.NoError(t, j.Shutdown(context.Background()))
+
+		assert.Empty(t, u.files())
+		assert.FileExists(t, filepath.Join(dir, "test_log-2018-01-30.1.log"))
+	})
+
+	t.Run("errors of the background work are returned", func(t *testing.T) {
+		dir := makeTestDir(randomString(14), t)
+		defer os.RemoveAll(dir)
+
+		u := &fakeUploader{}
+		u.fail(errors.New("s3 is down"))
+
+		j := New(prefix, dir, WithCompressionAndCloudUploader(u), WithFinalRotation(), withNowFunc(nowFunc))
+
+		_, err := j.Write([]byte("last words\n"))
+		require.NoError(t, err)
+
+		err = j.Shutdown(context.Background())
+		require.Error(t, err)
+
+		var e *Error
+		require.True(t, errors.As(err, &e))
+		assert.Equal(t, OpUpload, e.Op)
+		assert.Contains(t, err.Error(), "s3 is down")
+
+		// the archive is uploaded on the next start
+		assert.FileExists(t, filepath.Join(dir, "test_log-2018-01-30.1.log.gz"))
+	})
+
+	t.Run("waiting ends with the context", func(t *testing.T) {
+		dir := makeTestDir(randomString(14), t)
+		defer os.RemoveAll(dir)
+
+		release := make(chan struct{})
+		defer close(release)
+
+		hook := PostRotationFunc(func(f RotatedFile) (RotatedFile, error) {
+			<-release
+			return f, nil
+		})
+
+		j := New(prefix, dir, WithPostRotationHook(hook), WithFinalRotation(), withNowFunc(nowFunc))
+
+		_, err := j.Write([]byte("last words\n"))
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		err = j.Shutdown(ctx)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+		var e *Error
+		require.True(t, errors.As(err, &e))
+		assert.Equal(t, OpShutdown, e.Op)
+	})
+
+	t.Run("errors.Is and errors.As look into every error", func(t *testing.T) {
+		uf := uncompressedIdenticalTestFileFactory(prefix, "uncompressed fake - log - content")
+		cleanUp, dir, err := createFakeLogFiles(randomString(14), uf("2018-01-28", 1))
+		require.NoError(t, err)
+		defer cleanUp()
+
+		release := make(chan struct{})
+		defer close(release)
+
+		hook := PostRotationFunc(func(f RotatedFile) (RotatedFile, error) {
+			<-release
+			return f, nil
+		})
+
+		j := New(prefix, dir, WithPostRotationHook(hook), WithNextTick(10*time.Millisecond), withNowFunc(nowFunc))
+
+		_, err = j.Write([]byte("last words\n"))
+		require.NoError(t, err)
+
+		// closing the current file fails besides the deadline
+		j.cmu.Lock()
+		require.NoError(t, j.currentFile.Close())
+		j.cmu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		err = j.Shutdown(ctx)
+
+		var errs Errors
+		require.True(t, errors.As(err, &errs))
+		assert.Len(t, errs, 2)
+
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.True(t, errors.Is(err, os.ErrClosed))
+
+		var e *Error
+		require.True(t, errors.As(err, &e))
+		assert.Equal(t, OpWrite, e.Op)
+	})
+}
@@ -0,0 +1,86 @@
+package juggler
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of what Juggler did since it was created
+type Stats struct {
+	BytesWritten   uint64
+	Writes         uint64
+	DroppedWrites  uint64
+	Rotations      uint64
+	CurrentFile    string
+	CurrentVersion int
+
+	Compressions        uint64
+	CompressionFailures uint64
+	// BytesCompressed and BytesAfterCompression are the sizes of files before and after compression
+	BytesCompressed       uint64
+	BytesAfterCompression uint64
+	// CompressionRatio is BytesAfterCompression to BytesCompressed, zero before anything is compressed
+	CompressionRatio float64
+
+	Uploads        uint64
+	UploadFailures uint64
+	BytesUploaded  uint64
+	// UploadDuration is the time spent uploading, failed attempts included
+	UploadDuration time.Duration
+	// UploadLatency is the average time an upload attempt takes
+	UploadLatency time.Duration
+
+	Pruned uint64
+}
+
+// counters are updated atomically by the writer and by the processing of rotated files
+type counters struct {
+	bytesWritten          uint64
+	writes                uint64
+	rotations             uint64
+	compressions          uint64
+	compressionFailures   uint64
+	bytesCompressed       uint64
+	bytesAfterCompression uint64
+	uploads               uint64
+	uploadFailures        uint64
+	bytesUploaded         uint64
+	uploadNanos           uint64
+	pruned                uint64
+}
+
+// Stats returns counters of writes, rotations and processing of rotated files
+func (j *Juggler) Stats() Stats {
+	c := j.counters
+
+	s := Stats{
+		BytesWritten:          atomic.LoadUint64(&c.bytesWritten),
+		Writes:                atomic.LoadUint64(&c.writes),
+		DroppedWrites:         j.Dropped(),
+		Rotations:             atomic.LoadUint64(&c.rotations),
+		Compressions:          atomic.LoadUint64(&c.compressions),
+		CompressionFailures:   atomic.LoadUint64(&c.compressionFailures),
+		BytesCompressed:       atomic.LoadUint64(&c.bytesCompressed),
+		BytesAfterCompression: atomic.LoadUint64(&c.bytesAfterCompression),
+		Uploads:               atomic.LoadUint64(&c.uploads),
+		UploadFailures:        atomic.LoadUint64(&c.uploadFailures),
+		BytesUploaded:         atomic.LoadUint64(&c.bytesUploaded),
+		UploadDuration:        time.Duration(atomic.LoadUint64(&c.uploadNanos)),
+		Pruned:                atomic.LoadUint64(&c.pruned),
+	}
+
+	if s.BytesCompressed > 0 {
+		s.CompressionRatio = float64(s.BytesAfterCompression) / float64(s.BytesCompressed)
+	}
+
+	if attempts := s.Uploads + s.UploadFailures; attempts > 0 {
+		s.UploadLatency = s.UploadDuration / time.Duration(attempts)
+	}
+
+	j.cmu.RLock()
+	s.CurrentFile = j.currentFilepath
+	s.CurrentVersion = j.currentVersion
+	j.cmu.RUnlock()
+
+	return s
+}
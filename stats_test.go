@@ -0,0 +1,72 @@
+package juggler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	prefix := "test_log"
+	uf := uncompressedIdenticalTestFileFactory(prefix, "uncompressed fake - log - content")
+	nowFunc := createNowFunc(dateSuffix, "2018-01-30")
+
+	cleanUp, dir, err := createFakeLogFiles(randomString(14), uf("2018-01-27", 1), uf("2018-01-28", 1), uf("2018-01-29", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer cleanUp()
+
+	u := &fakeUploader{}
+	j := New(
+		prefix,
+		dir,
+		WithCompressionAndCloudUploader(u),
+		WithMaxBackups(1),
+		withNowFunc(nowFunc),
+	)
+
+	defer j.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := j.Write([]byte("new log line\n"))
+		require.NoError(t, err)
+	}
+
+	<-time.After(300 * time.Millisecond)
+
+	s := j.Stats()
+	assert.Equal(t, uint64(3), s.Writes)
+	assert.Equal(t, uint64(39), s.BytesWritten)
+	assert.Equal(t, 1, s.CurrentVersion)
+	assert.Contains(t, s.CurrentFile, "test_log-2018-01-30.1.log")
+
+	assert.Equal(t, uint64(3), s.Compressions)
+	assert.Equal(t, uint64(0), s.CompressionFailures)
+	assert.Equal(t, uint64(3*len("uncompressed fake - log - content")), s.BytesCompressed)
+	assert.True(t, s.BytesAfterCompression > 0)
+	assert.InDelta(t, float64(s.BytesAfterCompression)/float64(s.BytesCompressed), s.CompressionRatio, 0.0001)
+
+	assert.Equal(t, uint64(3), s.Uploads)
+	assert.Equal(t, uint64(0), s.UploadFailures)
+	assert.Equal(t, s.BytesAfterCompression, s.BytesUploaded)
+	assert.Equal(t, s.UploadDuration/3, s.UploadLatency)
+
+	t.Run("prometheus", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		j.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+		body, err := ioutil.ReadAll(rec.Body)
+		require.NoError(t, err)
+
+		assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+		assert.Contains(t, string(body), "# TYPE juggler_writes_total counter\n")
+		assert.Contains(t, string(body), `juggler_writes_total{prefix="test_log"} 3`+"\n")
+		assert.Contains(t, string(body), `juggler_uploads_total{prefix="test_log"} 3`+"\n")
+		assert.Contains(t, string(body), `juggler_upload_duration_seconds_count{prefix="test_log"} 3`+"\n")
+	})
+}
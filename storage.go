@@ -1,174 +1,579 @@
 package juggler
 
 import (
+	"context"
+	"github.com/denismitr/juggler/codec"
 	"github.com/pkg/errors"
 	"os"
-	"regexp"
+	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type storage interface {
-	start(runCh <-chan struct{}, errCh chan<- error)
+	start(sweepCh <-chan struct{}, rotatedCh <-chan string, errCh chan<- error)
 }
 
-type uploader interface {
+// Uploader sends a rotated file to a remote storage
+type Uploader interface {
 	Upload(filepath string) error
 }
 
-func (j *Juggler) createStorage() storage {
-	if j.uploader != nil && j.compression {
-		return newCloudCompression(j.directory, j.prefix, j.uploader, j.format, j.nowFunc, j.timezone)
+// ChecksumUploader is implemented by uploaders which make sure the uploaded object matches
+// the given checksums of the file, the file is removed locally only if it does
+type ChecksumUploader interface {
+	Uploader
+	UploadWithChecksum(filepath string, md5, sha256 []byte) error
+}
+
+// ContextUploader is implemented by uploaders which give up once ctx is done, uploads are
+// cancelled when they time out, see WithUploadTimeout, and when Shutdown stops waiting for them
+type ContextUploader interface {
+	UploadWithContext(ctx context.Context, filepath string) error
+}
+
+// ChecksumContextUploader is ChecksumUploader which gives up once ctx is done
+type ChecksumContextUploader interface {
+	ContextUploader
+	UploadWithChecksumContext(ctx context.Context, filepath string, md5, sha256 []byte) error
+}
+
+// AdaptUploader turns an Uploader into a ContextUploader. Uploaders which are context aware
+// already are returned as they are, others cannot be cancelled, ctx is checked before
+// the upload starts only.
+func AdaptUploader(u Uploader) ContextUploader {
+	if cu, ok := u.(ContextUploader); ok {
+		return cu
 	}
 
+	return uploaderAdapter{u}
+}
+
+type uploaderAdapter struct {
+	Uploader
+}
+
+func (a uploaderAdapter) UploadWithContext(ctx context.Context, fp string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return a.Upload(fp)
+}
+
+func (a uploaderAdapter) UploadWithChecksumContext(ctx context.Context, fp string, md5, sha256 []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if cu, ok := a.Uploader.(ChecksumUploader); ok {
+		return cu.UploadWithChecksum(fp, md5, sha256)
+	}
+
+	return a.Upload(fp)
+}
+
+// RotatedFile describes a log file which is not written to anymore
+type RotatedFile struct {
+	Path    string
+	Date    time.Time
+	Version int
+	Size    int64
+
+	// MD5 and SHA256 are the checksums of the compressed file, nil if the file is not compressed.
+	// Hooks changing the content of the file must reset them.
+	MD5    []byte
+	SHA256 []byte
+}
+
+// PostRotationHook is a single step of post rotation processing. It returns the file
+// to be handed to the next step, which differs from the received one if the file
+// was moved or transformed, or a file with an empty Path if the file was consumed
+// and there is nothing left to process. Files which failed to be processed are kept
+// and run again from the failed step on the next sweep. Files are processed one
+// at a time, Process is never called concurrently.
+type PostRotationHook interface {
+	Process(f RotatedFile) (RotatedFile, error)
+}
+
+// PostRotationFunc allows using ordinary functions as post rotation hooks
+type PostRotationFunc func(f RotatedFile) (RotatedFile, error)
+
+func (fn PostRotationFunc) Process(f RotatedFile) (RotatedFile, error) {
+	return fn(f)
+}
+
+// createStorage assembles the pipeline: compression comes first,
+// then custom hooks in the order they were given, then upload
+func (j *Juggler) createStorage() storage {
+	var stages []PostRotationHook
+	var uploads *uploadStage
+
 	if j.compression {
-		return newLocalCompression(j.directory, j.prefix, j.format, j.nowFunc, j.timezone)
+		stages = append(stages, compressStage{codec: j.codec, counters: j.counters})
+	}
+
+	stages = append(stages, j.hooks...)
+
+	if j.uploader != nil {
+		uploads = newUploadStage(j.uploadCtx, j.uploader, j.keepUploaded, j.uploadRetry, j.uploadTimeout, j.counters)
+		stages = append(stages, uploads)
+	}
+
+	p := newPipeline(j.directory, j.naming, j.retention, j.nowFunc, j.activeFile, stages...)
+	p.uploads = uploads
+	p.counters = j.counters
+
+	if uploads != nil {
+		p.outbox = newOutbox(j.directory, j.prefix)
+	}
+
+	if len(stages) > 0 {
+		p.done = newProcessedJournal(j.directory, j.prefix)
+	}
+
+	return p
+}
+
+// pipeline runs every rotated file through the configured stages
+// and prunes whatever is left locally according to the retention rules
+type pipeline struct {
+	dir       string
+	naming    *filenameTemplate
+	retention retention
+	nowFunc   nowFunc
+	active    func() string
+	stages    []PostRotationHook
+	uploads   *uploadStage
+	outbox    *journal
+	done      *journal
+	counters  *counters
+
+	mu        sync.Mutex
+	processed map[string]bool
+	stalled   map[string]stalledRun
+}
+
+// stalledRun is a file which failed a stage other than upload, uploads are retried by the upload stage
+type stalledRun struct {
+	file  RotatedFile
+	stage int
+}
+
+func newPipeline(
+	dir string,
+	naming *filenameTemplate,
+	r retention,
+	nowFunc nowFunc,
+	active func() string,
+	stages ...PostRotationHook,
+) *pipeline {
+	return &pipeline{
+		dir:       dir,
+		naming:    naming,
+		retention: r,
+		nowFunc:   nowFunc,
+		active:    active,
+		stages:    stages,
+		processed: make(map[string]bool),
+		stalled:   make(map[string]stalledRun),
+		counters:  &counters{},
 	}
+}
+
+// start processes files as soon as they are rotated, sweeps catch whatever was missed,
+// e.g. files rotated before a restart, and prune. Only sweeps read the whole directory.
+func (p *pipeline) start(sweepCh <-chan struct{}, rotatedCh <-chan string, errCh chan<- error) {
+	p.recall(errCh)
+	p.replay(errCh)
 
-	return newLimitedStorage(j.maxBackups, j.directory, j.prefix, j.format, j.nowFunc, j.timezone)
+	for {
+		retry, stop := p.uploads.retryTimer()
+
+		select {
+		case _, ok := <-sweepCh:
+			if !ok {
+				stop()
+				return
+			}
+
+			if len(p.stages) > 0 {
+				p.processBackups(errCh)
+			}
+
+			p.prune(errCh)
+		case path := <-rotatedCh:
+			if len(p.stages) > 0 {
+				p.processRotated(path, errCh)
+			}
+		case <-retry:
+			p.retryUploads(errCh)
+		}
+
+		stop()
+	}
 }
 
-type base struct {
-	dir    string
-	prefix string
-	format *regexp.Regexp
-	tz     *time.Location
-	nowFunc func() time.Time
+func (p *pipeline) processRotated(path string, errCh chan<- error) {
+	f, ok, err := p.lookup(path)
+	if err != nil {
+		errCh <- err
+		return
+	}
+
+	if !ok || f.compressed || p.isProcessed(path) || p.isHeld(path) || path == p.active() {
+		return
+	}
+
+	p.run(f.rotated(), 0, errCh)
 }
 
-type localCompression struct {
-	base
+// lookup describes a log file by its path, files which do not exist or
+// whose names do not follow the naming template are not reported
+func (p *pipeline) lookup(path string) (logFileMeta, bool, error) {
+	rel, err := filepath.Rel(p.dir, path)
+	if err != nil {
+		return logFileMeta{}, false, opError(OpScan, path, errors.Wrapf(err, "file %s is outside of %s", path, p.dir), false)
+	}
+
+	fi, err := osStat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return logFileMeta{}, false, nil
+		}
+
+		return logFileMeta{}, false, opError(OpScan, path, errors.Wrapf(err, "failed to read stats from file %s", path), true)
+	}
+
+	f, ok := parseLogFileMeta(path, filepath.ToSlash(rel), fi, p.naming, p.nowFunc)
+
+	return f, ok, nil
 }
 
-func newLocalCompression(dir, prefix string, format *regexp.Regexp, nowFunc nowFunc, tz *time.Location) *localCompression {
-	return &localCompression{
-		base: base{
-			dir:    dir,
-			prefix: prefix,
-			format: format,
-			tz:     tz,
-			nowFunc: nowFunc,
-		},
+// recall remembers the files processed by previous runs which are still there,
+// the ones which are gone meanwhile are dropped from the journal
+func (p *pipeline) recall(errCh chan<- error) {
+	if p.done == nil {
+		return
+	}
+
+	paths, err := p.done.load()
+	if err != nil {
+		errCh <- err
+		return
+	}
+
+	for _, path := range paths {
+		if _, err := osStat(path); err != nil {
+			p.forget(path, errCh)
+			continue
+		}
+
+		p.mu.Lock()
+		p.processed[path] = true
+		p.mu.Unlock()
 	}
 }
 
-func (b *localCompression) start(runCh <-chan struct{}, errCh chan<- error) {
-	for range runCh {
-		var wg sync.WaitGroup
+// replay schedules the upload of files which were on their way to the remote storage
+// when the previous run stopped. Files which did not get compressed are left to the sweep.
+func (p *pipeline) replay(errCh chan<- error) {
+	if p.outbox == nil {
+		return
+	}
+
+	paths, err := p.outbox.load()
+	if err != nil {
+		errCh <- err
+		return
+	}
+
+	for _, path := range paths {
+		target := p.pending(path)
+
+		if target != path {
+			p.track(path, target, errCh)
+		}
+
+		if target == "" {
+			continue
+		}
 
-		files, err := scanBackups(b.dir, b.prefix, b.format, b.nowFunc, b.tz)
+		f, ok, err := p.lookup(target)
 		if err != nil {
 			errCh <- err
 			continue
 		}
 
-		for _, f := range files {
-			wg.Add(1)
-			go compressAndRemove(f.fullPath(), &wg, errCh, nil)
+		if ok {
+			p.uploads.schedule(f.rotated())
+		} else if fi, err := osStat(target); err == nil {
+			// moved by a custom hook, the name says nothing about the date
+			p.uploads.schedule(RotatedFile{Path: target, Size: fi.Size()})
 		}
+	}
+}
 
-		wg.Wait()
+// pending finds what became of a file journaled by a previous run, the process
+// might have stopped after the file was compressed but before the journal was updated
+func (p *pipeline) pending(path string) string {
+	if f, ok, _ := p.lookup(path); ok && !f.compressed {
+		return ""
+	}
+
+	if _, err := osStat(path); err == nil {
+		return path
+	}
+
+	for _, ext := range p.naming.extensions {
+		if _, err := osStat(path + ext); err == nil {
+			return path + ext
+		}
 	}
+
+	return ""
 }
 
-type limitedStorage struct {
-	base
-	maxBackups int
+// track follows a file on its way through the stages, so that it is not lost
+// if the process stops before the file is uploaded
+func (p *pipeline) track(old, new string, errCh chan<- error) {
+	if p.outbox == nil || old == new {
+		return
+	}
+
+	if err := p.outbox.replace(old, new); err != nil {
+		errCh <- err
+	}
 }
 
-func newLimitedStorage(maxBackups int, dir, prefix string, format *regexp.Regexp, nowFunc nowFunc, tz *time.Location) *limitedStorage {
-	return &limitedStorage{
-		base: base{
-			dir:    dir,
-			prefix: prefix,
-			format: format,
-			tz:     tz,
-			nowFunc: nowFunc,
-		},
-		maxBackups: maxBackups,
+// rotated scans the log directory for files other than the one written to
+func (p *pipeline) rotated(scan func(string, *filenameTemplate, nowFunc) ([]logFileMeta, error)) ([]logFileMeta, error) {
+	files, err := scan(p.dir, p.naming, p.nowFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	active := p.active()
+	result := files[:0]
+
+	for _, f := range files {
+		if f.fullPath() != active {
+			result = append(result, f)
+		}
 	}
+
+	return result, nil
 }
 
-func (b *limitedStorage) start(runCh <-chan struct{}, errCh chan<- error) {
-	for range runCh {
-		var wg sync.WaitGroup
+func (p *pipeline) processBackups(errCh chan<- error) {
+	p.resume(errCh)
 
-		files, err := scanBackups(b.dir, b.prefix, b.format, b.nowFunc, b.tz)
-		if err != nil {
-			errCh <- err
+	files, err := p.rotated(scanBackups)
+	if err != nil {
+		errCh <- err
+		return
+	}
+
+	// one file at a time, so that hooks need not be safe for concurrent use
+	for _, f := range files {
+		if p.isProcessed(f.fullPath()) || p.isHeld(f.fullPath()) {
 			continue
 		}
 
-		var filesToDelete []logFileMeta
-		if len(files) > b.maxBackups {
-			filesToDelete = files[:len(files)-b.maxBackups]
+		p.run(f.rotated(), 0, errCh)
+	}
+}
+
+// run passes the file through the stages starting from the given one
+func (p *pipeline) run(f RotatedFile, from int, errCh chan<- error) {
+	p.track("", f.Path, errCh)
+
+	for i := from; i < len(p.stages); i++ {
+		s := p.stages[i]
+
+		next, err := s.Process(f)
+		if err != nil {
+			if _, upload := s.(*uploadStage); !upload {
+				p.stall(f, i)
+			}
+
+			errCh <- opError(OpHook, f.Path, err, true)
+			return
 		}
 
-		for i := range filesToDelete {
-			wg.Add(1)
-			go func(f logFileMeta) {
-				if err := os.Remove(f.fullPath()); err != nil {
-					errCh <- errors.Wrapf(err, "could not delete %s", f.fullPath())
-				}
+		p.track(f.Path, next.Path, errCh)
 
-				wg.Done()
-			}(files[i])
+		if next.Path == "" {
+			return
 		}
 
-		wg.Wait()
+		f = next
 	}
-}
 
-type cloudCompression struct {
-	base
-	uploader uploader
+	p.track(f.Path, "", errCh)
+	p.markProcessed(f.Path, errCh)
 }
 
-func newCloudCompression(dir, prefix string, uploader uploader, format *regexp.Regexp, nowFunc nowFunc, tz *time.Location) *cloudCompression {
-	return &cloudCompression{
-		base: base{
-			dir:    dir,
-			prefix: prefix,
-			format: format,
-			tz:     tz,
-			nowFunc: nowFunc,
-		},
-		uploader: uploader,
+// markProcessed remembers a file which stays where it is, e.g. uploaded
+// but kept locally, so that it is not processed again. Files sweeps
+// would pick up again are journaled for the next runs as well.
+func (p *pipeline) markProcessed(path string, errCh chan<- error) {
+	p.mu.Lock()
+	p.processed[path] = true
+	p.mu.Unlock()
+
+	if f, ok, _ := p.lookup(path); !ok || f.compressed || p.done == nil {
+		return
+	}
+
+	if err := p.done.replace("", path); err != nil {
+		errCh <- err
 	}
 }
 
-func (b *cloudCompression) start(runCh <-chan struct{}, errCh chan<- error) {
-	for range runCh {
-		var wg sync.WaitGroup
+// forget drops a file which is gone from the processed ones
+func (p *pipeline) forget(path string, errCh chan<- error) {
+	p.mu.Lock()
+	delete(p.processed, path)
+	p.mu.Unlock()
+
+	if p.done == nil {
+		return
+	}
+
+	if err := p.done.replace(path, ""); err != nil {
+		errCh <- err
+	}
+}
 
-		files, err := scanBackups(b.dir, b.prefix, b.format, b.nowFunc, b.tz)
+// retryUploads uploads again the files whose upload failed and is due for another attempt
+func (p *pipeline) retryUploads(errCh chan<- error) {
+	for _, f := range p.uploads.due(time.Now()) {
+		next, err := p.uploads.Process(f)
 		if err != nil {
 			errCh <- err
 			continue
 		}
 
-		nextCh := make(chan string, len(files))
+		p.track(f.Path, "", errCh)
 
-		for _, f := range files {
-			wg.Add(1)
-			go compressAndRemove(f.fullPath(), &wg, errCh, nextCh)
+		if next.Path != "" {
+			p.markProcessed(next.Path, errCh)
 		}
+	}
+}
 
-		go func() {
-			for f := range nextCh {
-				go func(filepath string) {
-					if err := b.uploader.Upload(filepath); err != nil {
-						errCh <- err
-					}
+// stall keeps the file which failed the stage, so that it is neither pruned
+// nor processed from scratch, the next sweep resumes it from the stage
+func (p *pipeline) stall(f RotatedFile, stage int) {
+	p.mu.Lock()
+	p.stalled[f.Path] = stalledRun{file: f, stage: stage}
+	p.mu.Unlock()
+}
 
-					if err := os.Remove(filepath); err != nil {
-						errCh <- err
-					}
-				}(f)
-			}
-		}()
+// resume runs stalled files again from the stage they failed, files
+// which are gone meanwhile are forgotten
+func (p *pipeline) resume(errCh chan<- error) {
+	p.mu.Lock()
+	stalled := p.stalled
+	p.stalled = make(map[string]stalledRun)
+	p.mu.Unlock()
 
-		wg.Wait()
-		close(nextCh)
+	paths := make([]string, 0, len(stalled))
+	for path := range stalled {
+		paths = append(paths, path)
 	}
+
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if _, err := osStat(path); os.IsNotExist(err) {
+			p.track(path, "", errCh)
+			continue
+		}
+
+		r := stalled[path]
+		p.run(r.file, r.stage, errCh)
+	}
+}
+
+// isHeld tells whether the file waits to be uploaded or to be processed again
+// and must not be touched by others
+func (p *pipeline) isHeld(path string) bool {
+	if p.uploads.isPending(path) {
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, ok := p.stalled[path]
+
+	return ok
+}
+
+func (p *pipeline) isProcessed(path string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.processed[path]
+}
+
+// prune removes plain and compressed backups which are not retained anymore, neither
+// the active file nor files waiting to be uploaded or processed again are removed or counted
+func (p *pipeline) prune(errCh chan<- error) {
+	files, err := p.rotated(scanLogFiles)
+	if err != nil {
+		errCh <- err
+		return
+	}
+
+	retained := files[:0]
+	for _, f := range files {
+		if !p.isHeld(f.fullPath()) {
+			retained = append(retained, f)
+		}
+	}
+
+	for _, f := range p.retention.expired(retained, p.nowFunc()) {
+		if err := os.Remove(f.fullPath()); err != nil && !os.IsNotExist(err) {
+			errCh <- opError(OpPrune, f.fullPath(), errors.Wrapf(err, "could not delete %s", f.fullPath()), true)
+			continue
+		}
+
+		atomic.AddUint64(&p.counters.pruned, 1)
+
+		p.forget(f.fullPath(), errCh)
+	}
+}
+
+type compressStage struct {
+	codec    codec.Codec
+	counters *counters
+}
+
+func (s compressStage) Process(f RotatedFile) (RotatedFile, error) {
+	dst, d, err := compressAndRemove(f.Path, s.codec)
+	if err != nil {
+		atomic.AddUint64(&s.counters.compressionFailures, 1)
+		return RotatedFile{}, opError(OpCompress, f.Path, err, true)
+	}
+
+	fi, err := osStat(dst)
+	if err != nil {
+		return RotatedFile{}, opError(OpCompress, dst, errors.Wrapf(err, "failed to read stats from file %s", dst), true)
+	}
+
+	atomic.AddUint64(&s.counters.compressions, 1)
+	atomic.AddUint64(&s.counters.bytesCompressed, uint64(f.Size))
+	atomic.AddUint64(&s.counters.bytesAfterCompression, uint64(fi.Size()))
+
+	f.Path = dst
+	f.Size = fi.Size()
+	f.MD5 = d.md5
+	f.SHA256 = d.sha256
+
+	return f, nil
 }
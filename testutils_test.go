@@ -1,11 +1,13 @@
 package juggler
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 )
@@ -51,6 +53,14 @@ func location(name string) *time.Location {
 	return l
 }
 
+func gzippedName(file string) string {
+	return file + ".gz"
+}
+
+func testNaming(prefix string) *filenameTemplate {
+	return mustFilenameTemplate(DefaultFilenameTemplate, prefix, "localhost", newPeriod(Daily), time.UTC)
+}
+
 const testTimeFormat = "2006-01-02T15-04-05.000"
 
 func uncompressedTestFileFactory(prefix string) func(string, string, int) testLogFile {
@@ -162,3 +172,83 @@ func parseLocation(tz string) *time.Location {
 	}
 	return l
 }
+
+type fakeUploader struct {
+	mu       sync.Mutex
+	uploaded []string
+	err      error
+}
+
+func (u *fakeUploader) Upload(fp string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.err != nil {
+		return u.err
+	}
+
+	u.uploaded = append(u.uploaded, filepath.Base(fp))
+
+	return nil
+}
+
+type fakeChecksumUploader struct {
+	fakeUploader
+	checksums map[string][]byte
+}
+
+func (u *fakeChecksumUploader) UploadWithChecksum(fp string, md5, sha256 []byte) error {
+	u.mu.Lock()
+	if u.checksums == nil {
+		u.checksums = make(map[string][]byte)
+	}
+
+	u.checksums[filepath.Base(fp)] = append(append([]byte(nil), md5...), sha256...)
+	u.mu.Unlock()
+
+	return u.Upload(fp)
+}
+
+func (u *fakeChecksumUploader) checksum(name string) []byte {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.checksums[name]
+}
+
+func (u *fakeUploader) fail(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.err = err
+}
+
+func (u *fakeUploader) files() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return append([]string(nil), u.uploaded...)
+}
+
+// blockingUploader hangs until its uploads are cancelled
+type blockingUploader struct {
+	mu        sync.Mutex
+	cancelled []error
+}
+
+func (u *blockingUploader) UploadWithContext(ctx context.Context, fp string) error {
+	<-ctx.Done()
+
+	u.mu.Lock()
+	u.cancelled = append(u.cancelled, ctx.Err())
+	u.mu.Unlock()
+
+	return ctx.Err()
+}
+
+func (u *blockingUploader) errors() []error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return append([]error(nil), u.cancelled...)
+}
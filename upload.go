@@ -0,0 +1,222 @@
+package juggler
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultUploadAttempts = 10
+	defaultMinBackoff     = time.Second
+	defaultMaxBackoff     = 5 * time.Minute
+	defaultUploadTimeout  = 10 * time.Minute
+)
+
+// retryPolicy tells how many times and how often a failed upload is tried again
+type retryPolicy struct {
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+}
+
+// backoff returns the delay before the next attempt: exponential growth
+// capped at maxBackoff, with jitter, so that many files failed at once
+// are not retried at once
+func (r retryPolicy) backoff(attempts int) time.Duration {
+	d := r.minBackoff
+	for i := 1; i < attempts && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+
+	if d <= 1 {
+		return d
+	}
+
+	half := d / 2
+
+	return half + time.Duration(rand.Int63n(int64(d-half)))
+}
+
+type pendingUpload struct {
+	file      RotatedFile
+	attempts  int
+	next      time.Time
+	exhausted bool
+}
+
+// uploadStage uploads files and removes them locally only once the upload
+// succeeded, files which failed to upload are kept and retried with backoff
+type uploadStage struct {
+	ctx      context.Context
+	uploader ContextUploader
+	keep     bool
+	retry    retryPolicy
+	timeout  time.Duration
+
+	counters *counters
+
+	mu      sync.Mutex
+	pending map[string]*pendingUpload
+}
+
+func newUploadStage(
+	ctx context.Context,
+	uploader ContextUploader,
+	keep bool,
+	retry retryPolicy,
+	timeout time.Duration,
+	c *counters,
+) *uploadStage {
+	return &uploadStage{
+		ctx:      ctx,
+		uploader: uploader,
+		keep:     keep,
+		retry:    retry,
+		timeout:  timeout,
+		counters: c,
+		pending:  make(map[string]*pendingUpload),
+	}
+}
+
+func (s *uploadStage) Process(f RotatedFile) (RotatedFile, error) {
+	started := time.Now()
+	err := s.upload(f)
+	atomic.AddUint64(&s.counters.uploadNanos, uint64(time.Since(started)))
+
+	if err != nil {
+		atomic.AddUint64(&s.counters.uploadFailures, 1)
+		return RotatedFile{}, s.failed(f, err)
+	}
+
+	atomic.AddUint64(&s.counters.uploads, 1)
+	atomic.AddUint64(&s.counters.bytesUploaded, uint64(f.Size))
+
+	s.mu.Lock()
+	delete(s.pending, f.Path)
+	s.mu.Unlock()
+
+	if s.keep {
+		return f, nil
+	}
+
+	if err := os.Remove(f.Path); err != nil && !os.IsNotExist(err) {
+		return RotatedFile{}, opError(OpUpload, f.Path, errors.Wrapf(err, "could not delete uploaded file %s", f.Path), false)
+	}
+
+	return RotatedFile{}, nil
+}
+
+// upload passes the known checksums on to uploaders verifying them, an attempt
+// is cancelled once it times out or uploads are cancelled altogether
+func (s *uploadStage) upload(f RotatedFile) error {
+	ctx := s.ctx
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(s.ctx, s.timeout)
+		defer cancel()
+	}
+
+	if u, ok := s.uploader.(ChecksumContextUploader); ok && f.MD5 != nil && f.SHA256 != nil {
+		return u.UploadWithChecksumContext(ctx, f.Path, f.MD5, f.SHA256)
+	}
+
+	return s.uploader.UploadWithContext(ctx, f.Path)
+}
+
+// failed schedules the next attempt or gives up once all attempts are used,
+// either way the file is kept locally
+func (s *uploadStage) failed(f RotatedFile, err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pending[f.Path]
+	if !ok {
+		p = &pendingUpload{file: f}
+		s.pending[f.Path] = p
+	}
+
+	p.attempts++
+
+	if s.retry.maxAttempts > 0 && p.attempts >= s.retry.maxAttempts {
+		p.exhausted = true
+		return opError(OpUpload, f.Path, errors.Wrapf(err, "giving up uploading %s after %d attempts, the file is kept", f.Path, p.attempts), false)
+	}
+
+	p.next = time.Now().Add(s.retry.backoff(p.attempts))
+
+	return opError(OpUpload, f.Path, errors.Wrapf(err, "could not upload %s, attempt %d", f.Path, p.attempts), true)
+}
+
+// schedule makes the file due for upload right away
+func (s *uploadStage) schedule(f RotatedFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.pending[f.Path]; !ok {
+		s.pending[f.Path] = &pendingUpload{file: f}
+	}
+}
+
+// due returns the files whose next upload attempt is due
+func (s *uploadStage) due(now time.Time) []RotatedFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []RotatedFile
+	for _, p := range s.pending {
+		if !p.exhausted && !p.next.After(now) {
+			result = append(result, p.file)
+		}
+	}
+
+	return result
+}
+
+// retryTimer fires when the earliest retry is due, the returned func releases the timer
+func (s *uploadStage) retryTimer() (<-chan time.Time, func()) {
+	if s == nil {
+		return nil, func() {}
+	}
+
+	s.mu.Lock()
+	var next time.Time
+	found := false
+	for _, p := range s.pending {
+		if !p.exhausted && (!found || p.next.Before(next)) {
+			next = p.next
+			found = true
+		}
+	}
+	s.mu.Unlock()
+
+	if !found {
+		return nil, func() {}
+	}
+
+	t := time.NewTimer(time.Until(next))
+
+	return t.C, func() { t.Stop() }
+}
+
+// isPending tells whether the file failed to upload and must not be touched by others
+func (s *uploadStage) isPending(path string) bool {
+	if s == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.pending[path]
+
+	return ok
+}